@@ -0,0 +1,34 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/model"
+)
+
+// DataSource reads a site and returns its measurements in normalised form.
+// New transports (e.g. Modbus) only have to implement this interface.
+type DataSource interface {
+	Name() string
+	Fetch(ctx context.Context) (*model.Measurements, error)
+}
+
+// New returns the data source matching the configured inverter type.
+func New(inverterType string, client *fronius.Client) (DataSource, error) {
+	switch inverterType {
+	case model.InverterTypeNotHybrid:
+		return NewSolarAPI(client), nil
+	case model.InverterTypeHybrid:
+		return NewPowerflow(client), nil
+	}
+	return nil, fmt.Errorf("unsupported inverter type '%s'", inverterType)
+}
+
+func valueOf(v *float64) float64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
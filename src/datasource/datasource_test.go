@@ -0,0 +1,237 @@
+package datasource
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/model"
+	"github.com/thingsplex/fronius/simulator"
+)
+
+func TestSolarAPI(t *testing.T) {
+	sim := simulator.New()
+	defer sim.Close()
+	src := NewSolarAPI(fronius.NewClient(sim.Host(), nil))
+
+	meas, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meas.Sleeping {
+		t.Error("inverter reported as sleeping")
+	}
+	if meas.Site.PowerPV != 1604 || meas.Site.EnergyDay != 8190 || meas.Site.EnergyTotal != 27280602 {
+		t.Errorf("unexpected site values %+v", meas.Site)
+	}
+	inverters := meas.DevicesOfType(model.DeviceTypeInverter)
+	if len(inverters) != 1 || inverters[0].Power != 1604 {
+		t.Errorf("unexpected inverters %+v", inverters)
+	}
+}
+
+func TestSolarAPIWithMeter(t *testing.T) {
+	sim := simulator.New()
+	defer sim.Close()
+	sim.SetSite(simulator.MeterSite())
+	src := NewSolarAPI(fronius.NewClient(sim.Host(), nil))
+
+	meas, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meas.Site.HasGrid || meas.Site.HasLoad {
+		t.Errorf("meter read without being enabled %+v", meas.Site)
+	}
+
+	src.SetMeter(true)
+	meas, err = src.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := meas.Site
+	if !site.HasGrid || site.PowerGrid != -604 || !site.HasLoad || site.PowerLoad != -1000 {
+		t.Errorf("unexpected site power %+v", site)
+	}
+	if site.RelAutonomy != 100 || math.Abs(site.RelSelfConsumption-62.34) > 0.01 {
+		t.Errorf("unexpected ratios %+v", site)
+	}
+
+	sim.UpdateSite(func(site *simulator.Site) { site.PowerGrid = 500 })
+	meas, _ = src.Fetch(context.Background())
+	if meas.Site.PowerLoad != -2104 || math.Abs(meas.Site.RelAutonomy-76.24) > 0.01 || meas.Site.RelSelfConsumption != 100 {
+		t.Errorf("unexpected values while importing %+v", meas.Site)
+	}
+}
+
+func TestSolarAPIScenarios(t *testing.T) {
+	sim := simulator.New()
+	defer sim.Close()
+	src := NewSolarAPI(fronius.NewClient(sim.Host(), nil))
+
+	tests := []struct {
+		name     string
+		scenario simulator.Scenario
+		sleeping bool
+		err      bool
+	}{
+		{"night", simulator.ScenarioNight, true, false},
+		{"night with empty body", simulator.ScenarioNightEmpty, true, false},
+		{"server error", simulator.ScenarioError, false, true},
+		{"malformed json", simulator.ScenarioMalformed, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim.Script(simulator.Step{Scenario: tt.scenario, Count: 1})
+			meas, err := src.Fetch(context.Background())
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meas.Sleeping != tt.sleeping {
+				t.Errorf("sleeping = %v, want %v", meas.Sleeping, tt.sleeping)
+			}
+		})
+	}
+}
+
+func TestSlowResponse(t *testing.T) {
+	sim := simulator.New()
+	defer sim.Close()
+	sim.SetDelay(2 * time.Second)
+	src := NewSolarAPI(fronius.NewClient(sim.Host(), nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := src.Fetch(ctx); err == nil {
+		t.Fatal("expected the request to time out")
+	}
+}
+
+func TestPowerflow(t *testing.T) {
+	sim := simulator.New()
+	defer sim.Close()
+	sim.SetSite(simulator.HybridSite())
+	src := NewPowerflow(fronius.NewClient(sim.Host(), nil))
+
+	meas, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := meas.Site
+	if site.PowerPV != 4200 || site.PowerGrid != -1200 || site.PowerLoad != -2400 || site.PowerBattery != -600 {
+		t.Errorf("unexpected site power %+v", site)
+	}
+	if !site.HasGrid || !site.HasLoad || !site.HasBattery {
+		t.Errorf("meter and battery not detected %+v", site)
+	}
+	inverters := meas.DevicesOfType(model.DeviceTypeInverter)
+	if len(inverters) != 1 || inverters[0].Soc != 57.5 {
+		t.Errorf("unexpected inverters %+v", inverters)
+	}
+
+	sim.Script(simulator.Step{Scenario: simulator.ScenarioNight, Count: 1})
+	meas, err = src.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meas.Sleeping {
+		t.Error("inverter not reported as sleeping")
+	}
+}
+
+func TestReadInverterData(t *testing.T) {
+	sim := simulator.New()
+	defer sim.Close()
+	client := fronius.NewClient(sim.Host(), nil)
+
+	tests := []struct {
+		name   string
+		site   simulator.Site
+		reader InverterDataReader
+	}{
+		{"common inverter data", simulator.DefaultSite(), NewSolarAPI(client)},
+		{"components api", simulator.HybridSite(), NewPowerflow(client)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim.SetSite(tt.site)
+			data, err := tt.reader.ReadInverterData(context.Background(), []string{"1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dc := data["1"].DCInputs
+			if len(dc) != 2 || dc[0].Index != 1 || dc[0].Voltage != 412.3 || dc[1].Index != 2 || dc[1].Current != 0.35 {
+				t.Fatalf("unexpected DC inputs %+v", dc)
+			}
+			if math.Abs(dc[1].Power-139.51) > 0.01 {
+				t.Errorf("unexpected power of input 2 %+v", dc[1])
+			}
+		})
+	}
+}
+
+func TestReadGrid(t *testing.T) {
+	sim := simulator.New()
+	defer sim.Close()
+	client := fronius.NewClient(sim.Host(), nil)
+	data, err := NewSolarAPI(client).ReadInverterData(context.Background(), []string{"1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := data["1"].Grid; v.Voltage != 231.4 || v.Frequency != 49.98 || v.Current == 0 {
+		t.Errorf("unexpected grid values %+v", v)
+	}
+
+	sim.SetSite(simulator.HybridSite())
+	src := NewPowerflow(client)
+	src.SetMeter(true)
+	meas, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meas.Site.GridVoltages) != 3 || meas.Site.GridVoltages[2] != 231.4 || meas.Site.GridFrequency != 49.98 {
+		t.Errorf("unexpected grid values of the meter %v %v", meas.Site.GridVoltages, meas.Site.GridFrequency)
+	}
+}
+
+func TestReadMinMax(t *testing.T) {
+	sim := simulator.New()
+	defer sim.Close()
+	values, err := NewSolarAPI(fronius.NewClient(sim.Host(), nil)).ReadMinMax(context.Background(), []string{"1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	minMax := values["1"]
+	if minMax.Date != time.Now().Format(model.DateLayout) || minMax.Day.PowerMax != 3821 || minMax.Day.VoltageACMax != 240.1 {
+		t.Fatalf("unexpected min/max values %+v", minMax)
+	}
+	if minMax.Year.PowerMax != 5012 || minMax.Total.VoltageDCMax != 640.5 {
+		t.Errorf("unexpected year and total values %+v", minMax)
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	sim := simulator.New()
+	defer sim.Close()
+	sim.SetSite(simulator.HybridSite())
+	src := NewPowerflow(fronius.NewClient(sim.Host(), nil))
+
+	devices, err := src.ListDevices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 3 {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+	if devices[0].Type != model.DeviceTypeInverter || devices[0].ID != "1" || devices[0].Serial != "31234567" {
+		t.Errorf("unexpected inverter %+v", devices[0])
+	}
+}
@@ -0,0 +1,52 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/model"
+)
+
+// DeviceLister is implemented by data sources that can list the devices of a site. Device info
+// rarely changes, so it's read at a much slower rate than measurements.
+type DeviceLister interface {
+	ListDevices(ctx context.Context) ([]model.DeviceIdentity, error)
+}
+
+// deviceClasses maps the Solar API device classes to the device types of the normalised model.
+var deviceClasses = map[string]string{
+	"Inverter": model.DeviceTypeInverter,
+	"Meter":    model.DeviceTypeMeter,
+	"Storage":  model.DeviceTypeStorage,
+}
+
+// listDevices reads the active devices of the Datamanager. It works for hybrid and non-hybrid
+// installations alike.
+func listDevices(ctx context.Context, client *fronius.Client) ([]model.DeviceIdentity, error) {
+	info, err := client.GetActiveDeviceInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if info.Head.Status.Code != fronius.StatusOK {
+		return nil, fmt.Errorf("solar api error %d: %s", info.Head.Status.Code, info.Head.Status.Reason)
+	}
+	var devices []model.DeviceIdentity
+	for class, byID := range info.Body.Data {
+		deviceType, ok := deviceClasses[class]
+		if !ok {
+			continue
+		}
+		for id, dev := range byID {
+			devices = append(devices, model.DeviceIdentity{ID: id, Type: deviceType, Serial: dev.Serial, Name: dev.CustomName, FroniusType: dev.DT})
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Type != devices[j].Type {
+			return devices[i].Type < devices[j].Type
+		}
+		return devices[i].ID < devices[j].ID
+	})
+	return devices, nil
+}
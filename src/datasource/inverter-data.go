@@ -0,0 +1,60 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/model"
+)
+
+// InverterDataReader is implemented by data sources that read the DC inputs (MPPT) and the AC
+// values of the inverters. It's an extra request per inverter, so they are read at a slower rate
+// than the measurements.
+type InverterDataReader interface {
+	ReadInverterData(ctx context.Context, inverters []string) (map[string]model.InverterData, error)
+}
+
+// ReadInverterData reads the CommonInverterData of every inverter once. It reports the DC inputs
+// as UDC, IDC, UDC_2, IDC_2 and so on, and the AC values as UAC, IAC and FAC.
+func (s *SolarAPI) ReadInverterData(ctx context.Context, inverters []string) (map[string]model.InverterData, error) {
+	values := make(map[string]model.InverterData, len(inverters))
+	for _, id := range inverters {
+		data, err := s.client.GetCommonInverterData(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if data.Head.Status.Code != fronius.StatusOK {
+			return nil, fmt.Errorf("solar api error %d: %s", data.Head.Status.Code, data.Head.Status.Reason)
+		}
+		inverter := model.InverterData{DCInputs: dcInputs(data.DCInputs())}
+		grid := &inverter.Grid
+		grid.Voltage, _ = data.Value("UAC")
+		grid.Current, _ = data.Value("IAC")
+		grid.Frequency, _ = data.Value("FAC")
+		values[id] = inverter
+	}
+	return values, nil
+}
+
+// ReadInverterData reads the per MPPT channels of the components API of GEN24 inverters. Every
+// GEN24 is its own Datamanager, so the inputs belong to its only inverter. The AC values aren't
+// read, the grid is measured by the meter.
+func (p *Powerflow) ReadInverterData(ctx context.Context, inverters []string) (map[string]model.InverterData, error) {
+	if len(inverters) != 1 {
+		return nil, fmt.Errorf("DC inputs can't be assigned to %d inverters", len(inverters))
+	}
+	readable, err := p.client.GetReadable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]model.InverterData{inverters[0]: {DCInputs: dcInputs(readable.DCInputs())}}, nil
+}
+
+func dcInputs(inputs []fronius.DCInput) []model.DCInput {
+	var result []model.DCInput
+	for _, input := range inputs {
+		result = append(result, model.DCInput{Index: input.Index, Voltage: input.Voltage, Current: input.Current, Power: input.Power})
+	}
+	return result
+}
@@ -0,0 +1,48 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/model"
+)
+
+// MinMaxReader is implemented by data sources that can read the extremes the inverters log
+// (MinMaxInverterData). They change slowly, so they are read at a much slower rate than measurements.
+type MinMaxReader interface {
+	ReadMinMax(ctx context.Context, inverters []string) (map[string]model.InverterMinMax, error)
+}
+
+func (s *SolarAPI) ReadMinMax(ctx context.Context, inverters []string) (map[string]model.InverterMinMax, error) {
+	return readMinMax(ctx, s.client, inverters)
+}
+
+func (p *Powerflow) ReadMinMax(ctx context.Context, inverters []string) (map[string]model.InverterMinMax, error) {
+	return readMinMax(ctx, p.client, inverters)
+}
+
+// readMinMax reads the MinMaxInverterData of every inverter, dated with the local day they were read on.
+func readMinMax(ctx context.Context, client *fronius.Client, inverters []string) (map[string]model.InverterMinMax, error) {
+	result := make(map[string]model.InverterMinMax, len(inverters))
+	for _, id := range inverters {
+		data, err := client.GetMinMaxInverterData(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if data.Head.Status.Code != fronius.StatusOK {
+			return nil, fmt.Errorf("solar api error %d: %s", data.Head.Status.Code, data.Head.Status.Reason)
+		}
+		values := data.Body.Data
+		now := time.Now()
+		result[id] = model.InverterMinMax{
+			Date:   now.Format(model.DateLayout),
+			ReadAt: now,
+			Day:    model.MinMax{PowerMax: values.DayPMax.Value, VoltageACMax: values.DayUACMax.Value, VoltageACMin: values.DayUACMin.Value, VoltageDCMax: values.DayUDCMax.Value},
+			Year:   model.MinMax{PowerMax: values.YearPMax.Value, VoltageACMax: values.YearUACMax.Value, VoltageACMin: values.YearUACMin.Value, VoltageDCMax: values.YearUDCMax.Value},
+			Total:  model.MinMax{PowerMax: values.TotalPMax.Value, VoltageACMax: values.TotalUACMax.Value, VoltageACMin: values.TotalUACMin.Value, VoltageDCMax: values.TotalUDCMax.Value},
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/model"
+)
+
+// Powerflow reads the site power flow of hybrid installations (inverter, meter and storage).
+// The powerflow has no grid voltages, they are read from the meter if the site has one.
+type Powerflow struct {
+	client *fronius.Client
+	meter  bool
+}
+
+func NewPowerflow(client *fronius.Client) *Powerflow {
+	return &Powerflow{client: client}
+}
+
+func (p *Powerflow) Name() string {
+	return "powerflow"
+}
+
+// SetMeter enables reading the grid voltages from the Smart Meter.
+func (p *Powerflow) SetMeter(present bool) {
+	p.meter = present
+}
+
+func (p *Powerflow) ListDevices(ctx context.Context) ([]model.DeviceIdentity, error) {
+	return listDevices(ctx, p.client)
+}
+
+func (p *Powerflow) Fetch(ctx context.Context) (*model.Measurements, error) {
+	pf, err := p.client.GetPowerflow(ctx)
+	if err != nil {
+		return nil, err
+	}
+	meas := model.NewMeasurements(p.Name())
+	meas.Sleeping = len(pf.Inverters) == 0
+	site := pf.Site
+	meas.Site = model.SiteMeasurements{
+		PowerPV:            valueOf(site.PPv),
+		PowerGrid:          valueOf(site.PGrid),
+		PowerLoad:          valueOf(site.PLoad),
+		PowerBattery:       valueOf(site.PAkku),
+		HasGrid:            site.PGrid != nil,
+		HasLoad:            site.PLoad != nil,
+		HasBattery:         site.PAkku != nil,
+		EnergyDay:          valueOf(site.EDay),
+		EnergyYear:         valueOf(site.EYear),
+		EnergyTotal:        valueOf(site.ETotal),
+		RelAutonomy:        site.RelAutonomy,
+		RelSelfConsumption: site.RelSelfConsumption,
+	}
+	for _, inv := range pf.Inverters {
+		meas.Devices = append(meas.Devices, model.DeviceMeasurement{
+			ID:          strconv.Itoa(inv.ID),
+			Type:        model.DeviceTypeInverter,
+			Power:       inv.P,
+			EnergyDay:   valueOf(inv.EDay),
+			EnergyYear:  valueOf(inv.EYear),
+			EnergyTotal: valueOf(inv.ETotal),
+			Soc:         inv.Soc,
+			BatteryMode: inv.BatMode,
+		})
+	}
+	if p.meter {
+		if err := p.readGridValues(ctx, &meas.Site); err != nil {
+			log.Debug("<poller> Can't read smart meter - ", err)
+		}
+	}
+	return meas, nil
+}
+
+func (p *Powerflow) readGridValues(ctx context.Context, site *model.SiteMeasurements) error {
+	meters, err := p.client.GetMeterRealtimeData(ctx)
+	if err != nil {
+		return err
+	}
+	if meters.Head.Status.Code != fronius.StatusOK {
+		return fmt.Errorf("solar api error %d: %s", meters.Head.Status.Code, meters.Head.Status.Reason)
+	}
+	for _, meter := range meters.Body.Data {
+		if meter.Location == fronius.MeterLocationGrid {
+			setGridValues(site, meter)
+			return nil
+		}
+	}
+	return fmt.Errorf("no meter at the feed-in point")
+}
@@ -0,0 +1,137 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/model"
+)
+
+// MeterReader is implemented by data sources that read the Smart Meter with a separate request,
+// which is only worth it when the Datamanager lists a meter.
+type MeterReader interface {
+	SetMeter(present bool)
+}
+
+// SolarAPI reads the legacy inverter realtime data (Scope=System) of non-hybrid installations.
+// It only reports power and energy, the AC and DC values are read with ReadInverterData. With a
+// Smart Meter the grid power is read as well, and the load and the self-consumption
+// ratios are derived from it the way the powerflow of hybrid inverters does.
+type SolarAPI struct {
+	client *fronius.Client
+	meter  bool
+}
+
+func NewSolarAPI(client *fronius.Client) *SolarAPI {
+	return &SolarAPI{client: client}
+}
+
+func (s *SolarAPI) Name() string {
+	return "solar_api"
+}
+
+func (s *SolarAPI) SetMeter(present bool) {
+	s.meter = present
+}
+
+func (s *SolarAPI) ListDevices(ctx context.Context) ([]model.DeviceIdentity, error) {
+	return listDevices(ctx, s.client)
+}
+
+func (s *SolarAPI) Fetch(ctx context.Context) (*model.Measurements, error) {
+	sys, err := s.client.GetRealTimeData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	meas := model.NewMeasurements(s.Name())
+	if sys.IsAsleep() {
+		meas.Sleeping = true
+		if s.meter {
+			// the house keeps consuming at night
+			if err := s.readMeter(ctx, &meas.Site); err != nil {
+				log.Debug("<poller> Can't read smart meter - ", err)
+			}
+		}
+		return meas, nil
+	}
+	if sys.Head.Status.Code != fronius.StatusOK {
+		return nil, fmt.Errorf("solar api error %d: %s", sys.Head.Status.Code, sys.Head.Status.Reason)
+	}
+	data := sys.Body.Data
+	meas.Site.PowerPV = data.Power.Value.Value
+	meas.Site.EnergyDay = data.EnergyDay.Value.Value
+	meas.Site.EnergyYear = data.EnergyYear.Value.Value
+	meas.Site.EnergyTotal = data.EnergyTotal.Value.Value
+	meas.Devices = append(meas.Devices, model.DeviceMeasurement{
+		ID:          "1",
+		Type:        model.DeviceTypeInverter,
+		Power:       data.Power.Value.Value,
+		EnergyDay:   data.EnergyDay.Value.Value,
+		EnergyYear:  data.EnergyYear.Value.Value,
+		EnergyTotal: data.EnergyTotal.Value.Value,
+		StatusCode:  int(data.DeviceStatus.StatusCode),
+	})
+	if s.meter {
+		// the inverter values are still worth publishing without the meter
+		if err := s.readMeter(ctx, &meas.Site); err != nil {
+			log.Debug("<poller> Can't read smart meter - ", err)
+		}
+	}
+	return meas, nil
+}
+
+// readMeter sets the grid power from the meters at the feed-in point. Without a battery the load
+// is what the inverter produces plus what is imported.
+func (s *SolarAPI) readMeter(ctx context.Context, site *model.SiteMeasurements) error {
+	meters, err := s.client.GetMeterRealtimeData(ctx)
+	if err != nil {
+		return err
+	}
+	if meters.Head.Status.Code != fronius.StatusOK {
+		return fmt.Errorf("solar api error %d: %s", meters.Head.Status.Code, meters.Head.Status.Reason)
+	}
+	grid, found := 0.0, false
+	for _, meter := range meters.Body.Data {
+		if meter.Location == fronius.MeterLocationGrid {
+			if !found {
+				setGridValues(site, meter)
+			}
+			grid += meter.PowerRealSum
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no meter at the feed-in point")
+	}
+	site.PowerGrid, site.HasGrid = grid, true
+	site.PowerLoad, site.HasLoad = -math.Max(site.PowerPV+grid, 0), true
+	site.RelAutonomy = relAutonomy(grid, -site.PowerLoad)
+	site.RelSelfConsumption = relSelfConsumption(grid, site.PowerPV)
+	return nil
+}
+
+// setGridValues sets the phase voltages and the frequency of the grid measured by meter.
+func setGridValues(site *model.SiteMeasurements, meter fronius.MeterData) {
+	site.GridVoltages = []float64{meter.VoltageACPhase1, meter.VoltageACPhase2, meter.VoltageACPhase3}
+	site.GridFrequency = meter.Frequency
+}
+
+// relAutonomy is the share of the load not covered by the grid in %, as the powerflow reports it.
+func relAutonomy(grid, load float64) float64 {
+	if load <= 0 || grid <= 0 {
+		return 100
+	}
+	return math.Max(100*(1-grid/load), 0)
+}
+
+// relSelfConsumption is the share of the production not fed into the grid in %.
+func relSelfConsumption(grid, pv float64) float64 {
+	if pv <= 0 || grid >= 0 {
+		return 100
+	}
+	return math.Max(100*(1+grid/pv), 0)
+}
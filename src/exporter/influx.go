@@ -0,0 +1,233 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/model"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// maxRetryInterval is the longest wait between attempts while the target is unavailable.
+const maxRetryInterval = 10 * time.Minute
+
+// lineWriter writes a batch of lines, all or none.
+type lineWriter interface {
+	write(ctx context.Context, lines []string) error
+	close() error
+}
+
+// Influx buffers the measurements as InfluxDB line protocol and writes them in batches. While
+// the target is unavailable lines are kept up to the configured buffer size and retried with
+// backoff, the oldest lines are dropped first.
+type Influx struct {
+	conf          model.InfluxConfig
+	writer        lineWriter
+	mux           sync.Mutex
+	buffer        []string
+	dropped       int
+	evicted       int
+	failures      int
+	retryAt       time.Time
+	flushCh       chan struct{}
+	stopCh        chan struct{}
+	doneCh        chan struct{}
+	flushInterval time.Duration
+}
+
+// NewInflux returns the exporter configured in configs, writing to the URL or to files in the data dir.
+func NewInflux(configs *model.Configs) *Influx {
+	conf := configs.Influx
+	var writer lineWriter
+	if conf.URL != "" {
+		writer = &httpLineWriter{url: conf.URL, token: conf.Token, client: &http.Client{Timeout: 30 * time.Second}}
+	} else {
+		writer = &fileLineWriter{out: &lumberjack.Logger{Filename: configs.GetInfluxFile(), MaxSize: conf.FileMaxSize(), MaxBackups: 5}}
+	}
+	return &Influx{conf: conf, writer: writer, flushCh: make(chan struct{}, 1), flushInterval: conf.FlushInterval()}
+}
+
+// Add buffers the lines of the measurements, a full batch is written right away.
+func (in *Influx) Add(meas *model.Measurements) {
+	lines := encodeLines(meas, in.conf)
+	in.mux.Lock()
+	in.buffer = append(in.buffer, lines...)
+	if over := len(in.buffer) - in.conf.MaxBuffered(); over > 0 {
+		if in.dropped == 0 {
+			log.Warn("<influx> Buffer full, dropping the oldest lines")
+		}
+		in.dropped += over
+		in.evicted += over
+		in.buffer = append([]string(nil), in.buffer[over:]...)
+	}
+	full := len(in.buffer) >= in.conf.MaxBatch()
+	in.mux.Unlock()
+	if full {
+		select {
+		case in.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Start writes buffered lines in the background, every flush interval or when a batch is full.
+func (in *Influx) Start() {
+	in.stopCh = make(chan struct{})
+	in.doneCh = make(chan struct{})
+	go in.run()
+	log.Info("<influx> Exporting measurements to ", in.target())
+}
+
+// Stop tries to write what is buffered and closes the target.
+func (in *Influx) Stop() {
+	if in.stopCh == nil {
+		return
+	}
+	close(in.stopCh)
+	<-in.doneCh
+	if err := in.writer.close(); err != nil {
+		log.Warn("<influx> Can't close target. Error: ", err)
+	}
+}
+
+func (in *Influx) run() {
+	defer close(in.doneCh)
+	ticker := time.NewTicker(in.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-in.stopCh:
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			in.flush(ctx, true)
+			cancel()
+			return
+		case <-ticker.C:
+		case <-in.flushCh:
+		}
+		in.flush(context.Background(), false)
+	}
+}
+
+// flush writes the buffer batch by batch until it's empty or a write fails. Unless force is set
+// nothing is written before the retry time after a failure.
+func (in *Influx) flush(ctx context.Context, force bool) {
+	for {
+		in.mux.Lock()
+		if len(in.buffer) == 0 || (!force && time.Now().Before(in.retryAt)) {
+			in.mux.Unlock()
+			return
+		}
+		n := in.conf.MaxBatch()
+		if n > len(in.buffer) {
+			n = len(in.buffer)
+		}
+		batch := append([]string(nil), in.buffer[:n]...)
+		evicted := in.evicted
+		in.mux.Unlock()
+
+		if err := in.writer.write(ctx, batch); err != nil {
+			in.mux.Lock()
+			in.failures++
+			wait := in.flushInterval << uint(minInt(in.failures-1, 10))
+			if wait > maxRetryInterval {
+				wait = maxRetryInterval
+			}
+			in.retryAt = time.Now().Add(wait)
+			if in.failures == 1 {
+				log.Error("<influx> Can't write measurements, keeping them buffered - ", err)
+			} else {
+				log.Debug("<influx> Can't write measurements - ", err)
+			}
+			in.mux.Unlock()
+			return
+		}
+
+		in.mux.Lock()
+		// lines of the batch may have been dropped from the front while writing
+		if remaining := n - (in.evicted - evicted); remaining > 0 {
+			in.buffer = in.buffer[remaining:]
+		}
+		if in.failures > 0 || in.dropped > 0 {
+			log.Infof("<influx> Writing measurements again after %d failed attempts, %d lines were dropped", in.failures, in.dropped)
+		}
+		in.failures, in.dropped, in.retryAt = 0, 0, time.Time{}
+		in.mux.Unlock()
+	}
+}
+
+// Buffered returns how many lines wait to be written.
+func (in *Influx) Buffered() int {
+	in.mux.Lock()
+	defer in.mux.Unlock()
+	return len(in.buffer)
+}
+
+func (in *Influx) target() string {
+	if w, ok := in.writer.(*httpLineWriter); ok {
+		return w.url
+	}
+	return in.writer.(*fileLineWriter).out.Filename
+}
+
+// httpLineWriter posts lines to the write endpoint of InfluxDB, a token is sent for InfluxDB 2.
+type httpLineWriter struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (w *httpLineWriter) write(ctx context.Context, lines []string) error {
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s responded with status %d: %s", w.url, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (w *httpLineWriter) close() error {
+	return nil
+}
+
+// fileLineWriter appends lines to a file that is rotated by size.
+type fileLineWriter struct {
+	out *lumberjack.Logger
+}
+
+func (w *fileLineWriter) write(_ context.Context, lines []string) error {
+	_, err := w.out.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	return err
+}
+
+func (w *fileLineWriter) close() error {
+	return w.out.Close()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,106 @@
+package exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thingsplex/fronius/model"
+)
+
+func testMeasurements() *model.Measurements {
+	meas := &model.Measurements{Timestamp: time.Unix(1600000000, 0), Source: "powerflow"}
+	meas.Site = model.SiteMeasurements{PowerPV: 4200, PowerGrid: -1200.5, HasGrid: true, EnergyTotal: 27280602}
+	meas.Devices = []model.DeviceMeasurement{{ID: "1", Type: model.DeviceTypeInverter, Power: 4200, StatusCode: 7}}
+	return meas
+}
+
+func TestEncodeLines(t *testing.T) {
+	conf := model.InfluxConfig{SiteMeasurement: "solar site", Tags: map[string]string{"home": "Hytte, Nord", "empty": ""}}
+	lines := encodeLines(testMeasurements(), conf)
+	expected := []string{
+		`solar\ site,home=Hytte\,\ Nord,source=powerflow p_pv=4200,e_day=0,e_year=0,e_total=27280602,sleeping=false,p_grid=-1200.5 1600000000000000000`,
+		`fronius_device,home=Hytte\,\ Nord,id=1,type=inverter p=4200,e_day=0,e_year=0,e_total=0,u_ac=0,i_ac=0,freq=0,u_dc=0,i_dc=0,status_code=7i 1600000000000000000`,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("got %d lines: %v", len(lines), lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("line %d\n got %s\nwant %s", i, lines[i], expected[i])
+		}
+	}
+}
+
+func TestInfluxBuffersWhileUnavailable(t *testing.T) {
+	var mux sync.Mutex
+	var received []string
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		if fail {
+			http.Error(w, "database not ready", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Token secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+	}))
+	defer server.Close()
+
+	configs := &model.Configs{Influx: model.InfluxConfig{URL: server.URL, Token: "secret", BatchSize: 3, BufferSize: 5}}
+	influx := NewInflux(configs)
+	for i := 0; i < 2; i++ {
+		influx.Add(testMeasurements())
+	}
+	influx.flush(context.Background(), false)
+	if influx.Buffered() != 4 || influx.retryAt.IsZero() {
+		t.Fatalf("failed write not kept, %d buffered", influx.Buffered())
+	}
+	influx.Add(testMeasurements())
+	if influx.Buffered() != 5 || influx.dropped != 1 {
+		t.Errorf("buffer not limited, %d buffered, %d dropped", influx.Buffered(), influx.dropped)
+	}
+	influx.flush(context.Background(), false)
+	if influx.Buffered() != 5 {
+		t.Error("retried before the retry time")
+	}
+
+	mux.Lock()
+	fail = false
+	mux.Unlock()
+	influx.flush(context.Background(), true)
+	if influx.Buffered() != 0 || len(received) != 5 || influx.failures != 0 {
+		t.Errorf("%d buffered, %d received after recovery", influx.Buffered(), len(received))
+	}
+}
+
+func TestInfluxFile(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "fronius-influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	configs := &model.Configs{WorkDir: workDir, Influx: model.InfluxConfig{Enabled: true}}
+	influx := NewInflux(configs)
+	influx.Start()
+	influx.Add(testMeasurements())
+	influx.Stop()
+	body, err := ioutil.ReadFile(configs.GetInfluxFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(body)), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "fronius_site,source=powerflow ") {
+		t.Errorf("unexpected file content %s", body)
+	}
+}
@@ -0,0 +1,111 @@
+package exporter
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thingsplex/fronius/model"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// lineField is a field of a line, value is already formatted.
+type lineField struct {
+	key   string
+	value string
+}
+
+// encodeLines converts measurements to line protocol, one line for the site and one per device.
+func encodeLines(meas *model.Measurements, conf model.InfluxConfig) []string {
+	ts := strconv.FormatInt(meas.Timestamp.UnixNano(), 10)
+	site := meas.Site
+	fields := []lineField{
+		floatField("p_pv", site.PowerPV),
+		floatField("e_day", site.EnergyDay),
+		floatField("e_year", site.EnergyYear),
+		floatField("e_total", site.EnergyTotal),
+		{"sleeping", strconv.FormatBool(meas.Sleeping)},
+	}
+	if site.HasGrid {
+		fields = append(fields, floatField("p_grid", site.PowerGrid))
+	}
+	if site.HasLoad {
+		fields = append(fields, floatField("p_load", site.PowerLoad), floatField("rel_autonomy", site.RelAutonomy),
+			floatField("rel_self_consumption", site.RelSelfConsumption))
+	}
+	if site.HasBattery {
+		fields = append(fields, floatField("p_akku", site.PowerBattery))
+	}
+	lines := []string{encodeLine(conf.SiteMeasurementName(), tagsWith(conf.Tags, "source", meas.Source), fields, ts)}
+
+	for _, dev := range meas.Devices {
+		fields := []lineField{floatField("p", dev.Power)}
+		switch dev.Type {
+		case model.DeviceTypeInverter:
+			fields = append(fields,
+				floatField("e_day", dev.EnergyDay),
+				floatField("e_year", dev.EnergyYear),
+				floatField("e_total", dev.EnergyTotal),
+				floatField("u_ac", dev.VoltageAC),
+				floatField("i_ac", dev.CurrentAC),
+				floatField("freq", dev.Frequency),
+				floatField("u_dc", dev.VoltageDC),
+				floatField("i_dc", dev.CurrentDC),
+				lineField{"status_code", strconv.Itoa(dev.StatusCode) + "i"})
+			if dev.Soc > 0 {
+				fields = append(fields, floatField("soc", dev.Soc), floatField("bat_mode", dev.BatteryMode))
+			}
+		case model.DeviceTypeStorage:
+			fields = append(fields, floatField("soc", dev.Soc), floatField("bat_mode", dev.BatteryMode))
+		}
+		tags := tagsWith(conf.Tags, "type", dev.Type, "id", dev.ID)
+		lines = append(lines, encodeLine(conf.DeviceMeasurementName(), tags, fields, ts))
+	}
+	return lines
+}
+
+// tagsWith returns the configured tags with the given name and value pairs added.
+func tagsWith(configured map[string]string, pairs ...string) map[string]string {
+	tags := make(map[string]string, len(configured)+len(pairs)/2)
+	for key, value := range configured {
+		tags[key] = value
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		tags[pairs[i]] = pairs[i+1]
+	}
+	return tags
+}
+
+// encodeLine writes tags sorted by key, as InfluxDB recommends. Tags with empty values are left out.
+func encodeLine(measurement string, tags map[string]string, fields []lineField, ts string) string {
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(measurement))
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if tags[key] != "" {
+			b.WriteString("," + keyEscaper.Replace(key) + "=" + keyEscaper.Replace(tags[key]))
+		}
+	}
+	for i, field := range fields {
+		if i == 0 {
+			b.WriteString(" ")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(keyEscaper.Replace(field.key) + "=" + field.value)
+	}
+	b.WriteString(" " + ts)
+	return b.String()
+}
+
+func floatField(key string, value float64) lineField {
+	return lineField{key, strconv.FormatFloat(value, 'f', -1, 64)}
+}
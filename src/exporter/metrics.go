@@ -0,0 +1,88 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metricsWriter writes metrics in the Prometheus text exposition format. Samples of a family
+// have to be written right after the family.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func newMetricsWriter(w io.Writer) *metricsWriter {
+	return &metricsWriter{w: bufio.NewWriter(w)}
+}
+
+// family starts a metric family, metricType is gauge, counter or summary.
+func (m *metricsWriter) family(name, metricType, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// sample writes a value, labels are name and value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+		}
+		m.w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	m.w.WriteString(" " + formatValue(value) + "\n")
+}
+
+// gauge writes a family with a single sample.
+func (m *metricsWriter) gauge(name, help string, value float64, labels ...string) {
+	m.family(name, "gauge", help)
+	m.sample(name, value, labels...)
+}
+
+func (m *metricsWriter) counter(name, help string, value float64, labels ...string) {
+	m.family(name, "counter", help)
+	m.sample(name, value, labels...)
+}
+
+func (m *metricsWriter) flush() error {
+	return m.w.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
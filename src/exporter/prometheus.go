@@ -0,0 +1,219 @@
+package exporter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/handler"
+	"github.com/thingsplex/fronius/model"
+)
+
+// PollerStats is implemented by handler.Poller.
+type PollerStats interface {
+	Stats() handler.PollStats
+	Breaker() handler.BreakerStats
+	Health() handler.Health
+}
+
+// PublishCounter is implemented by handler.FromFimpRouter.
+type PublishCounter interface {
+	PublishCounts() map[string]uint64
+}
+
+// Prometheus serves the latest measurements and the adapter internals on /metrics, in the
+// Prometheus text format. Metrics are built from the state on every scrape, the inverter isn't
+// polled for it.
+type Prometheus struct {
+	configs   *model.Configs
+	state     *model.State
+	poller    PollerStats
+	publisher PublishCounter
+	server    *http.Server
+}
+
+func NewPrometheus(configs *model.Configs, state *model.State, poller PollerStats, publisher PublishCounter) *Prometheus {
+	return &Prometheus{configs: configs, state: state, poller: poller, publisher: publisher}
+}
+
+// Start listens on the configured address and serves metrics in the background.
+func (p *Prometheus) Start() error {
+	listener, err := net.Listen("tcp", p.configs.MetricsListenAddress())
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p)
+	p.server = &http.Server{Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	go func() {
+		if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("<metrics> Server stopped. Error: ", err)
+		}
+	}()
+	log.Info("<metrics> Serving metrics on ", listener.Addr(), "/metrics")
+	return nil
+}
+
+// Stop waits for scrapes in progress to complete.
+func (p *Prometheus) Stop() {
+	if p.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.server.Shutdown(ctx); err != nil {
+		log.Warn("<metrics> Can't stop server. Error: ", err)
+	}
+}
+
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := newMetricsWriter(w)
+	p.writeMeasurements(m)
+	p.writeInternals(m)
+	if err := m.flush(); err != nil {
+		log.Debug("<metrics> Can't write metrics - ", err)
+	}
+}
+
+func (p *Prometheus) writeMeasurements(m *metricsWriter) {
+	report := p.state.Report()
+	m.family("fronius_energy_counter_watt_hours", "counter", "Lifetime energy counter checked for glitches, as reported over FIMP.")
+	for _, name := range []string{model.CounterPV, model.CounterLoad} {
+		if counter, ok := report.Counters[name]; ok {
+			m.sample("fronius_energy_counter_watt_hours", counter.Total, "counter", name)
+		}
+	}
+	if !report.LastSuccess.IsZero() {
+		m.gauge("fronius_last_success_timestamp_seconds", "Time of the last successful poll.", unixSeconds(report.LastSuccess))
+	}
+
+	m.family("fronius_device_info", "gauge", "Devices listed by the Datamanager.")
+	for _, dev := range p.state.KnownDevices() {
+		m.sample("fronius_device_info", 1, "type", dev.Type, "id", dev.ID, "serial", dev.Serial, "name", dev.Name,
+			"fronius_type", strconv.Itoa(dev.FroniusType))
+	}
+
+	meas := p.state.LatestMeasurements()
+	if meas == nil {
+		return
+	}
+	site := meas.Site
+	m.gauge("fronius_site_measured_timestamp_seconds", "Time of the latest measurements.", unixSeconds(meas.Timestamp))
+	m.gauge("fronius_site_sleeping", "1 while the inverters sleep.", boolValue(meas.Sleeping))
+
+	m.family("fronius_site_power_watts", "gauge", "Site power, grid is positive when importing and battery when discharging.")
+	m.sample("fronius_site_power_watts", site.PowerPV, "flow", "pv")
+	if site.HasGrid {
+		m.sample("fronius_site_power_watts", site.PowerGrid, "flow", "grid")
+	}
+	if site.HasLoad {
+		m.sample("fronius_site_power_watts", site.PowerLoad, "flow", "load")
+	}
+	if site.HasBattery {
+		m.sample("fronius_site_power_watts", site.PowerBattery, "flow", "battery")
+	}
+
+	m.family("fronius_site_energy_watt_hours", "gauge", "Energy produced by the site as read from the inverters.")
+	m.sample("fronius_site_energy_watt_hours", site.EnergyDay, "period", "day")
+	m.sample("fronius_site_energy_watt_hours", site.EnergyYear, "period", "year")
+	m.sample("fronius_site_energy_watt_hours", site.EnergyTotal, "period", "total")
+
+	if site.HasLoad {
+		m.gauge("fronius_site_autonomy_percent", "Share of the load covered by the site.", site.RelAutonomy)
+		m.gauge("fronius_site_self_consumption_percent", "Share of the production consumed on site.", site.RelSelfConsumption)
+	}
+
+	deviceFamilies := []struct {
+		name, help, deviceType string
+		value                  func(dev model.DeviceMeasurement) float64
+	}{
+		{"fronius_device_power_watts", "Power of a device.", "",
+			func(dev model.DeviceMeasurement) float64 { return dev.Power }},
+		{"fronius_device_ac_voltage_volts", "AC voltage of an inverter.", model.DeviceTypeInverter,
+			func(dev model.DeviceMeasurement) float64 { return dev.VoltageAC }},
+		{"fronius_device_ac_current_amperes", "AC current of an inverter.", model.DeviceTypeInverter,
+			func(dev model.DeviceMeasurement) float64 { return dev.CurrentAC }},
+		{"fronius_device_ac_frequency_hertz", "AC frequency of an inverter.", model.DeviceTypeInverter,
+			func(dev model.DeviceMeasurement) float64 { return dev.Frequency }},
+		{"fronius_device_dc_voltage_volts", "DC voltage of an inverter.", model.DeviceTypeInverter,
+			func(dev model.DeviceMeasurement) float64 { return dev.VoltageDC }},
+		{"fronius_device_dc_current_amperes", "DC current of an inverter.", model.DeviceTypeInverter,
+			func(dev model.DeviceMeasurement) float64 { return dev.CurrentDC }},
+		{"fronius_device_status_code", "Fronius status code of an inverter.", model.DeviceTypeInverter,
+			func(dev model.DeviceMeasurement) float64 { return float64(dev.StatusCode) }},
+		{"fronius_battery_soc_percent", "State of charge of a battery.", model.DeviceTypeStorage,
+			func(dev model.DeviceMeasurement) float64 { return dev.Soc }},
+		{"fronius_battery_mode", "Fronius operating mode of a battery.", model.DeviceTypeStorage,
+			func(dev model.DeviceMeasurement) float64 { return dev.BatteryMode }},
+	}
+	for _, family := range deviceFamilies {
+		m.family(family.name, "gauge", family.help)
+		for _, dev := range meas.Devices {
+			if family.deviceType == "" || dev.Type == family.deviceType {
+				m.sample(family.name, family.value(dev), "type", dev.Type, "id", dev.ID)
+			}
+		}
+	}
+	m.family("fronius_device_energy_watt_hours", "gauge", "Energy produced by an inverter.")
+	for _, dev := range meas.DevicesOfType(model.DeviceTypeInverter) {
+		m.sample("fronius_device_energy_watt_hours", dev.EnergyDay, "type", dev.Type, "id", dev.ID, "period", "day")
+		m.sample("fronius_device_energy_watt_hours", dev.EnergyYear, "type", dev.Type, "id", dev.ID, "period", "year")
+		m.sample("fronius_device_energy_watt_hours", dev.EnergyTotal, "type", dev.Type, "id", dev.ID, "period", "total")
+	}
+
+	inputFamilies := []struct {
+		name, help string
+		value      func(input model.DCInput) float64
+	}{
+		{"fronius_dc_input_voltage_volts", "Voltage of a DC input (MPPT) of an inverter.", func(input model.DCInput) float64 { return input.Voltage }},
+		{"fronius_dc_input_current_amperes", "Current of a DC input (MPPT) of an inverter.", func(input model.DCInput) float64 { return input.Current }},
+		{"fronius_dc_input_power_watts", "Power of a DC input (MPPT) of an inverter.", func(input model.DCInput) float64 { return input.Power }},
+	}
+	for _, family := range inputFamilies {
+		m.family(family.name, "gauge", family.help)
+		for _, dev := range meas.DevicesOfType(model.DeviceTypeInverter) {
+			for _, input := range dev.DCInputs {
+				m.sample(family.name, family.value(input), "type", dev.Type, "id", dev.ID, "input", strconv.Itoa(input.Index))
+			}
+		}
+	}
+}
+
+func (p *Prometheus) writeInternals(m *metricsWriter) {
+	stats := p.poller.Stats()
+	m.counter("fronius_polls_total", "Polls since the adapter started, including failed ones.", float64(stats.Polls))
+	m.family("fronius_poll_duration_seconds", "summary", "Duration of polls.")
+	m.sample("fronius_poll_duration_seconds_sum", stats.TotalDuration.Seconds())
+	m.sample("fronius_poll_duration_seconds_count", float64(stats.Polls))
+	m.gauge("fronius_poll_last_duration_seconds", "Duration of the last poll.", stats.LastDuration.Seconds())
+
+	breaker := p.poller.Breaker()
+	m.counter("fronius_poll_failures_total", "Failed polls since the adapter started.", float64(breaker.Failures))
+	m.gauge("fronius_poll_consecutive_failures", "Failed polls and probes in a row.", float64(breaker.ConsecutiveFailures))
+	m.counter("fronius_probes_total", "Probes of the Datamanager while the circuit breaker was open.", float64(breaker.Probes))
+	m.counter("fronius_probe_failures_total", "Failed probes of the Datamanager.", float64(breaker.ProbeFailures))
+	m.counter("fronius_breaker_opened_total", "How often the circuit breaker opened.", float64(breaker.Opened))
+	m.family("fronius_breaker_state", "gauge", "State of the circuit breaker around inverter requests, 1 for the current state.")
+	for _, state := range []handler.BreakerState{handler.BreakerClosed, handler.BreakerOpen, handler.BreakerHalfOpen} {
+		m.sample("fronius_breaker_state", boolValue(breaker.State == state), "state", string(state))
+	}
+	m.gauge("fronius_connected", "1 while the inverter answers polls.", boolValue(p.poller.Health().Connected))
+
+	counts := p.publisher.PublishCounts()
+	m.family("fronius_mqtt_published_total", "counter", "Messages published to the broker.")
+	for _, msgType := range sortedKeys(counts) {
+		m.sample("fronius_mqtt_published_total", float64(counts[msgType]), "msg_type", msgType)
+	}
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
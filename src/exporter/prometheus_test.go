@@ -0,0 +1,96 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thingsplex/fronius/handler"
+	"github.com/thingsplex/fronius/model"
+	"github.com/thingsplex/fronius/utils"
+)
+
+type fakeAdapter struct{}
+
+func (fakeAdapter) Stats() handler.PollStats {
+	return handler.PollStats{Polls: 4, LastDuration: 200 * time.Millisecond, TotalDuration: time.Second}
+}
+
+func (fakeAdapter) Breaker() handler.BreakerStats {
+	return handler.BreakerStats{State: handler.BreakerOpen, Failures: 3, Opened: 1}
+}
+
+func (fakeAdapter) Health() handler.Health {
+	return handler.Health{Connected: false}
+}
+
+func (fakeAdapter) PublishCounts() map[string]uint64 {
+	return map[string]uint64{"evt.meter_ext.report": 7}
+}
+
+func newState(t *testing.T) (*model.State, string) {
+	workDir, err := ioutil.TempDir("", "fronius-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"data", "defaults"} {
+		os.MkdirAll(filepath.Join(workDir, dir), 0755)
+	}
+	if err := utils.CopyFile(filepath.Join("..", "..", "testdata", "defaults", "state.json"), filepath.Join(workDir, "defaults", "state.json")); err != nil {
+		t.Fatal(err)
+	}
+	return model.NewStates(workDir), workDir
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	state, workDir := newState(t)
+	defer os.RemoveAll(workDir)
+	meas := model.NewMeasurements("powerflow")
+	meas.Site = model.SiteMeasurements{PowerPV: 4200, PowerGrid: -1200, HasGrid: true, EnergyTotal: 27280602}
+	meas.Devices = []model.DeviceMeasurement{
+		{ID: "1", Type: model.DeviceTypeInverter, Power: 4200, VoltageAC: 230.5},
+		{ID: "0", Type: model.DeviceTypeStorage, Soc: 58},
+	}
+	state.SetMeasurements(meas)
+	state.SetDevices([]model.DeviceIdentity{{ID: "1", Type: model.DeviceTypeInverter, Serial: "31234567", Name: `GEN24 "roof"`}})
+	state.UpdateEnergyCounter(model.CounterPV, 27280602, meas.Timestamp, model.DefaultMaxSitePowerW)
+
+	rec := httptest.NewRecorder()
+	NewPrometheus(&model.Configs{}, state, fakeAdapter{}, fakeAdapter{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`fronius_site_power_watts{flow="pv"} 4200`,
+		`fronius_site_power_watts{flow="grid"} -1200`,
+		`fronius_site_energy_watt_hours{period="total"} 2.7280602e+07`,
+		`fronius_device_ac_voltage_volts{type="inverter",id="1"} 230.5`,
+		`fronius_battery_soc_percent{type="storage",id="0"} 58`,
+		`fronius_device_info{type="inverter",id="1",serial="31234567",name="GEN24 \"roof\"",fronius_type="0"} 1`,
+		`fronius_energy_counter_watt_hours{counter="pv"} 2.7280602e+07`,
+		`fronius_poll_duration_seconds_sum 1`,
+		`fronius_poll_duration_seconds_count 4`,
+		`fronius_breaker_state{state="open"} 1`,
+		`fronius_breaker_state{state="closed"} 0`,
+		`fronius_mqtt_published_total{msg_type="evt.meter_ext.report"} 7`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+	if strings.Contains(body, `flow="load"`) {
+		t.Error("load reported without a meter")
+	}
+}
+
+func TestPrometheusWithoutMeasurements(t *testing.T) {
+	state, workDir := newState(t)
+	defer os.RemoveAll(workDir)
+	rec := httptest.NewRecorder()
+	NewPrometheus(&model.Configs{}, state, fakeAdapter{}, fakeAdapter{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "fronius_polls_total 4\n") || strings.Contains(rec.Body.String(), "fronius_site_power_watts{") {
+		t.Errorf("unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+}
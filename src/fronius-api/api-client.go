@@ -0,0 +1,138 @@
+package fronius
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Client fetches and decodes Solar API responses from a single Datamanager.
+type Client struct {
+	host       string
+	httpClient *http.Client
+}
+
+func NewClient(host string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{host: host, httpClient: httpClient}
+}
+
+func (c *Client) Host() string {
+	return c.host
+}
+
+// BaseURL returns the URL of the Datamanager, on port 80 unless host includes a port.
+func (c *Client) BaseURL() string {
+	if _, _, err := net.SplitHostPort(c.host); err == nil {
+		return "http://" + c.host
+	}
+	return fmt.Sprintf("%s%s%s", "http://", c.host, ":80")
+}
+
+func (c *Client) GetRealTimeData(ctx context.Context) (System, error) {
+	resp, err := c.get(ctx, GetRealTimeDataURL(c.BaseURL()))
+	if err != nil {
+		return System{}, err
+	}
+	defer resp.Body.Close()
+	return System{}.NewResponse(resp)
+}
+
+func (c *Client) GetPowerflow(ctx context.Context) (Powerflow, error) {
+	resp, err := c.get(ctx, GetPowerflowURL(c.BaseURL()))
+	if err != nil {
+		return Powerflow{}, err
+	}
+	defer resp.Body.Close()
+	return Powerflow{}.NewPowerflowResponse(resp)
+}
+
+// GetCommonInverterData reads the realtime values of the inverter with the given device id.
+func (c *Client) GetCommonInverterData(ctx context.Context, deviceID string) (CommonInverterData, error) {
+	resp, err := c.get(ctx, GetCommonInverterDataURL(c.BaseURL(), deviceID))
+	if err != nil {
+		return CommonInverterData{}, err
+	}
+	defer resp.Body.Close()
+	data := CommonInverterData{}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	return data, err
+}
+
+// GetMinMaxInverterData reads the extremes logged by the inverter with the given device id.
+func (c *Client) GetMinMaxInverterData(ctx context.Context, deviceID string) (MinMaxInverterData, error) {
+	resp, err := c.get(ctx, GetMinMaxInverterDataURL(c.BaseURL(), deviceID))
+	if err != nil {
+		return MinMaxInverterData{}, err
+	}
+	defer resp.Body.Close()
+	data := MinMaxInverterData{}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	return data, err
+}
+
+// GetReadable reads the channels of the internal components API of GEN24 inverters.
+func (c *Client) GetReadable(ctx context.Context) (Readable, error) {
+	resp, err := c.get(ctx, GetReadableURL(c.BaseURL()))
+	if err != nil {
+		return Readable{}, err
+	}
+	defer resp.Body.Close()
+	data := Readable{}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	return data, err
+}
+
+// GetMeterRealtimeData reads all Smart Meters of the site.
+func (c *Client) GetMeterRealtimeData(ctx context.Context) (MeterRealtimeData, error) {
+	resp, err := c.get(ctx, GetMeterRealtimeDataURL(c.BaseURL()))
+	if err != nil {
+		return MeterRealtimeData{}, err
+	}
+	defer resp.Body.Close()
+	meters := MeterRealtimeData{}
+	err = json.NewDecoder(resp.Body).Decode(&meters)
+	return meters, err
+}
+
+// GetAPIVersion is the cheapest request to the Datamanager, it's used to check if it can be reached.
+func (c *Client) GetAPIVersion(ctx context.Context) (APIVersion, error) {
+	resp, err := c.get(ctx, GetAPIVersionURL(c.BaseURL()))
+	if err != nil {
+		return APIVersion{}, err
+	}
+	defer resp.Body.Close()
+	version := APIVersion{}
+	err = json.NewDecoder(resp.Body).Decode(&version)
+	return version, err
+}
+
+// GetActiveDeviceInfo lists the inverters, meters and storages connected to the Datamanager.
+func (c *Client) GetActiveDeviceInfo(ctx context.Context) (ActiveDeviceInfo, error) {
+	resp, err := c.get(ctx, GetActiveDeviceInfoURL(c.BaseURL()))
+	if err != nil {
+		return ActiveDeviceInfo{}, err
+	}
+	defer resp.Body.Close()
+	return ActiveDeviceInfo{}.NewActiveDeviceInfoResponse(resp)
+}
+
+func (c *Client) get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't create request for %s: %w", url, err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s responded with status %d", url, resp.StatusCode)
+	}
+	return resp, nil
+}
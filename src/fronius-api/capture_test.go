@@ -0,0 +1,48 @@
+package fronius
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/thingsplex/fronius/simulator"
+)
+
+func TestCaptureAndReplay(t *testing.T) {
+	sim := simulator.New()
+	defer sim.Close()
+
+	var capture bytes.Buffer
+	live := NewClient(sim.Host(), &http.Client{Transport: NewCaptureTransport(http.DefaultTransport, &capture)})
+	sys, err := live.GetRealTimeData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.UpdateSite(func(site *simulator.Site) { site.PowerPV = 900 })
+	if _, err := live.GetRealTimeData(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(capture.String(), "\n"); lines != 2 {
+		t.Fatalf("captured %d responses, want 2", lines)
+	}
+
+	replay, err := NewReplayTransport(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := NewClient("host_from_another_site", &http.Client{Transport: replay})
+	for _, want := range []float64{sys.Body.Data.Power.Value.Value, 900, sys.Body.Data.Power.Value.Value} {
+		got, err := replayed.GetRealTimeData(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Body.Data.Power.Value.Value != want {
+			t.Errorf("replayed PAC = %v, want %v", got.Body.Data.Power.Value.Value, want)
+		}
+	}
+	if _, err := replayed.GetPowerflow(context.Background()); err == nil {
+		t.Error("expected an error for a request that wasn't captured")
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -14,6 +17,9 @@ import (
 const (
 	api          = "solar_api/v1"
 	getInvRtData = "GetInverterRealtimeData.cgi"
+	getDevInfo   = "GetActiveDeviceInfo.cgi"
+	getMeterData = "GetMeterRealtimeData.cgi"
+	getAPIVer    = "solar_api/GetAPIVersion.cgi"
 	scope        = "Scope=System"
 	batteries    = "config/batteries"
 	exportLimit  = "config/exportlimit"
@@ -21,6 +27,19 @@ const (
 	powerflow    = "status/powerflow"
 )
 
+// Solar API response status codes (Head.Status.Code)
+const (
+	StatusOK                 = 0
+	StatusDeviceNotAvailable = 12
+)
+
+// Inverter status codes (DeviceStatus.StatusCode)
+const (
+	DeviceStatusRunning  = 7
+	DeviceStatusStandby  = 8
+	DeviceStatusSleeping = 13
+)
+
 type System struct {
 	Head struct {
 		RequestArguments struct {
@@ -135,31 +154,231 @@ type Powerflow struct {
 		Timestamp string `json:"timestamp"`
 	} `json:"common"`
 	Inverters []struct {
-		BatMode float64 `json:"BatMode"`
-		Cid     int     `json:"CID"`
-		Dt      int     `json:"DT"`
-		ID      int     `json:"ID"`
-		P       float64 `json:"P"`
-		Soc     float64 `json:"SOC"`
+		BatMode float64  `json:"BatMode"`
+		Cid     int      `json:"CID"`
+		Dt      int      `json:"DT"`
+		EDay    *float64 `json:"E_Day"`
+		ETotal  *float64 `json:"E_Total"`
+		EYear   *float64 `json:"E_Year"`
+		ID      int      `json:"ID"`
+		P       float64  `json:"P"`
+		Soc     float64  `json:"SOC"`
 	} `json:"inverters"`
 	Site struct {
-		BackupMode         bool        `json:"BackupMode"`
-		BatteryStandby     bool        `json:"BatteryStandby"`
-		EDay               interface{} `json:"E_Day"`
-		ETotal             interface{} `json:"E_Total"`
-		EYear              interface{} `json:"E_Year"`
-		MLoc               int         `json:"MLoc"`
-		Mode               string      `json:"Mode"`
-		PAkku              float64     `json:"P_Akku"`
-		PGrid              float64     `json:"P_Grid"`
-		PLoad              float64     `json:"P_Load"`
-		PPv                float64     `json:"P_PV"`
-		RelAutonomy        float64     `json:"rel_Autonomy"`
-		RelSelfConsumption float64     `json:"rel_SelfConsumption"`
+		BackupMode         bool     `json:"BackupMode"`
+		BatteryStandby     bool     `json:"BatteryStandby"`
+		EDay               *float64 `json:"E_Day"`
+		ETotal             *float64 `json:"E_Total"`
+		EYear              *float64 `json:"E_Year"`
+		MLoc               int      `json:"MLoc"`
+		Mode               string   `json:"Mode"`
+		PAkku              *float64 `json:"P_Akku"`
+		PGrid              *float64 `json:"P_Grid"`
+		PLoad              *float64 `json:"P_Load"`
+		PPv                *float64 `json:"P_PV"`
+		RelAutonomy        float64  `json:"rel_Autonomy"`
+		RelSelfConsumption float64  `json:"rel_SelfConsumption"`
 	} `json:"site"`
 	Version string `json:"version"`
 }
 
+// CommonInverterData are the realtime values of one inverter (Scope=Device). Values are decoded
+// on demand, as the number of DC inputs (UDC, UDC_2, ...) depends on the inverter.
+type CommonInverterData struct {
+	Head struct {
+		Status struct {
+			Code   int32  `json:"Code"`
+			Reason string `json:"Reason"`
+		} `json:"Status"`
+	} `json:"Head"`
+	Body struct {
+		Data map[string]json.RawMessage `json:"Data"`
+	} `json:"Body"`
+}
+
+// DCInput is one DC input (MPPT) of an inverter, numbered from 1.
+type DCInput struct {
+	Index   int
+	Voltage float64
+	Current float64
+	Power   float64
+}
+
+// Value returns a value of the inverter by name, e.g. UDC_2.
+func (d CommonInverterData) Value(name string) (float64, bool) {
+	raw, ok := d.Body.Data[name]
+	if !ok {
+		return 0, false
+	}
+	var value struct {
+		Unit  string   `json:"Unit"`
+		Value *float64 `json:"Value"`
+	}
+	if err := json.Unmarshal(raw, &value); err != nil || value.Value == nil {
+		return 0, false
+	}
+	return *value.Value, true
+}
+
+// DCInputs returns the DC inputs in order. The first one is reported as UDC and IDC, the
+// following ones with the input number as suffix.
+func (d CommonInverterData) DCInputs() []DCInput {
+	var inputs []DCInput
+	for index := 1; ; index++ {
+		suffix := ""
+		if index > 1 {
+			suffix = "_" + strconv.Itoa(index)
+		}
+		voltage, hasVoltage := d.Value("UDC" + suffix)
+		current, hasCurrent := d.Value("IDC" + suffix)
+		if !hasVoltage && !hasCurrent {
+			return inputs
+		}
+		inputs = append(inputs, DCInput{Index: index, Voltage: voltage, Current: current, Power: voltage * current})
+	}
+}
+
+// MinMaxInverterData are the extremes an inverter logged today, this year and since installation.
+type MinMaxInverterData struct {
+	Head struct {
+		Status struct {
+			Code   int32  `json:"Code"`
+			Reason string `json:"Reason"`
+		} `json:"Status"`
+	} `json:"Head"`
+	Body struct {
+		Data struct {
+			DayPMax     DeviceValue `json:"DAY_PMAX"`
+			DayUACMax   DeviceValue `json:"DAY_UACMAX"`
+			DayUACMin   DeviceValue `json:"DAY_UACMIN"`
+			DayUDCMax   DeviceValue `json:"DAY_UDCMAX"`
+			YearPMax    DeviceValue `json:"YEAR_PMAX"`
+			YearUACMax  DeviceValue `json:"YEAR_UACMAX"`
+			YearUACMin  DeviceValue `json:"YEAR_UACMIN"`
+			YearUDCMax  DeviceValue `json:"YEAR_UDCMAX"`
+			TotalPMax   DeviceValue `json:"TOTAL_PMAX"`
+			TotalUACMax DeviceValue `json:"TOTAL_UACMAX"`
+			TotalUACMin DeviceValue `json:"TOTAL_UACMIN"`
+			TotalUDCMax DeviceValue `json:"TOTAL_UDCMAX"`
+		} `json:"Data"`
+	} `json:"Body"`
+}
+
+// DeviceValue is a value in Device scope.
+type DeviceValue struct {
+	Unit  string  `json:"Unit"`
+	Value float64 `json:"Value"`
+}
+
+// Readable is the internal components API of GEN24 inverters, with the channels of every
+// component by component id.
+type Readable struct {
+	Body struct {
+		Data map[string]struct {
+			Channels map[string]float64 `json:"channels"`
+		} `json:"Data"`
+	} `json:"Body"`
+}
+
+// readableDCChannel matches the per MPPT channels of the components API, e.g. PV_VOLTAGE_MEAN_01_F32.
+var readableDCChannel = regexp.MustCompile(`^PV_(VOLTAGE|CURRENT|POWERACTIVE)_MEAN_(\d+)_F32$`)
+
+// DCInputs returns the DC inputs found in the channels of all components, in order.
+func (r Readable) DCInputs() []DCInput {
+	byIndex := make(map[int]*DCInput)
+	for _, component := range r.Body.Data {
+		for channel, value := range component.Channels {
+			match := readableDCChannel.FindStringSubmatch(channel)
+			if match == nil {
+				continue
+			}
+			index, _ := strconv.Atoi(match[2])
+			input, ok := byIndex[index]
+			if !ok {
+				input = &DCInput{Index: index}
+				byIndex[index] = input
+			}
+			switch match[1] {
+			case "VOLTAGE":
+				input.Voltage = value
+			case "CURRENT":
+				input.Current = value
+			case "POWERACTIVE":
+				input.Power = value
+			}
+		}
+	}
+	inputs := make([]DCInput, 0, len(byIndex))
+	for _, input := range byIndex {
+		inputs = append(inputs, *input)
+	}
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].Index < inputs[j].Index })
+	return inputs
+}
+
+// MeterRealtimeData holds the Smart Meters by device id. Power is positive when importing.
+type MeterRealtimeData struct {
+	Head struct {
+		Status struct {
+			Code   int32  `json:"Code"`
+			Reason string `json:"Reason"`
+		} `json:"Status"`
+	} `json:"Head"`
+	Body struct {
+		Data map[string]MeterData `json:"Data"`
+	} `json:"Body"`
+}
+
+// MeterData are the realtime values of one Smart Meter. Meter_Location_Current is 0 for a meter
+// at the feed-in point and 1 for a meter in the consumption path.
+type MeterData struct {
+	PowerRealSum    float64 `json:"PowerReal_P_Sum"`
+	EnergyConsumed  float64 `json:"EnergyReal_WAC_Sum_Consumed"`
+	EnergyProduced  float64 `json:"EnergyReal_WAC_Sum_Produced"`
+	Frequency       float64 `json:"Frequency_Phase_Average"`
+	Location        int     `json:"Meter_Location_Current"`
+	VoltageACPhase1 float64 `json:"Voltage_AC_Phase_1"`
+	VoltageACPhase2 float64 `json:"Voltage_AC_Phase_2"`
+	VoltageACPhase3 float64 `json:"Voltage_AC_Phase_3"`
+	CurrentACPhase1 float64 `json:"Current_AC_Phase_1"`
+	CurrentACPhase2 float64 `json:"Current_AC_Phase_2"`
+	CurrentACPhase3 float64 `json:"Current_AC_Phase_3"`
+}
+
+// Meter locations (MeterData.Location)
+const (
+	MeterLocationGrid = 0
+	MeterLocationLoad = 1
+)
+
+// APIVersion is the answer of GetAPIVersion.cgi, which every Datamanager serves without accessing the inverters.
+type APIVersion struct {
+	APIVersion         int    `json:"APIVersion"`
+	BaseURL            string `json:"BaseURL"`
+	CompatibilityRange string `json:"CompatibilityRange"`
+}
+
+// ActiveDeviceInfo lists the devices known to the Datamanager, by device class (Inverter, Meter,
+// Storage, ...) and device id.
+type ActiveDeviceInfo struct {
+	Head struct {
+		Status struct {
+			Code   int32  `json:"Code"`
+			Reason string `json:"Reason"`
+		} `json:"Status"`
+	} `json:"Head"`
+	Body struct {
+		Data map[string]map[string]DeviceInfo `json:"Data"`
+	} `json:"Body"`
+}
+
+// DeviceInfo identifies a device, DT is the Fronius device type code.
+type DeviceInfo struct {
+	DT         int    `json:"DT"`
+	Serial     string `json:"Serial"`
+	CustomName string `json:"CustomName"`
+}
+
 type State struct {
 	Value float64
 	Unit  string
@@ -170,7 +389,49 @@ func GetRealTimeDataURL(host string) string {
 	return url
 }
 
-// func
+func GetAPIVersionURL(host string) string {
+	return fmt.Sprintf("%s/%s", host, getAPIVer)
+}
+
+func GetActiveDeviceInfoURL(host string) string {
+	return fmt.Sprintf("%s/%s/%s?DeviceClass=System", host, api, getDevInfo)
+}
+
+func GetCommonInverterDataURL(host string, deviceID string) string {
+	return fmt.Sprintf("%s/%s/%s?Scope=Device&DeviceId=%s&DataCollection=CommonInverterData", host, api, getInvRtData, deviceID)
+}
+
+func GetMinMaxInverterDataURL(host string, deviceID string) string {
+	return fmt.Sprintf("%s/%s/%s?Scope=Device&DeviceId=%s&DataCollection=MinMaxInverterData", host, api, getInvRtData, deviceID)
+}
+
+func GetReadableURL(host string) string {
+	return fmt.Sprintf("%s/%s", host, readable)
+}
+
+func GetMeterRealtimeDataURL(host string) string {
+	return fmt.Sprintf("%s/%s/%s?%s", host, api, getMeterData, scope)
+}
+
+func GetPowerflowURL(host string) string {
+	return fmt.Sprintf("%s/%s", host, powerflow)
+}
+
+// HasData returns false when the logger answered with an empty Data body, which it does
+// while the inverters are switched off.
+func (sys System) HasData() bool {
+	data := sys.Body.Data
+	return data.Power.Unit != "" || data.EnergyDay.Unit != "" || data.EnergyTotal.Unit != ""
+}
+
+// IsAsleep returns true if the response tells that the inverters are switched off for the night.
+func (sys System) IsAsleep() bool {
+	if sys.Head.Status.Code == StatusDeviceNotAvailable || !sys.HasData() {
+		return true
+	}
+	status := sys.Body.Data.DeviceStatus.StatusCode
+	return status == DeviceStatusStandby || status == DeviceStatusSleeping
+}
 
 func (sys System) NewResponse(httpresp *http.Response) (system System, err error) {
 	body, err := ioutil.ReadAll(httpresp.Body)
@@ -205,6 +466,16 @@ func (pow Powerflow) NewPowerflowResponse(httpresp *http.Response) (powerf Power
 	return powerf, err
 }
 
+func (info ActiveDeviceInfo) NewActiveDeviceInfoResponse(httpresp *http.Response) (devInfo ActiveDeviceInfo, err error) {
+	body, err := ioutil.ReadAll(httpresp.Body)
+	if err != nil {
+		return devInfo, err
+	}
+
+	err = json.Unmarshal(body, &devInfo)
+	return devInfo, err
+}
+
 func (st State) CurrentPowerHybrid(powf Powerflow) State {
 	for _, inv := range powf.Inverters {
 		st.Value += inv.P
@@ -2,6 +2,7 @@ module github.com/thingsplex/fronius
 
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/futurehomeno/fimpgo v1.5.4
 	github.com/grandcat/zeroconf v1.0.0
 	github.com/hashicorp/mdns v1.0.3
@@ -3,32 +3,119 @@ package handler
 import (
 	"github.com/futurehomeno/fimpgo"
 	log "github.com/sirupsen/logrus"
-	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/model"
 )
 
-func (fc *FromFimpRouter) SendMeasurements(meas fronius.System) {
-	state := fronius.State{}
-	val := make(map[string]float64)
-	val["p_export"] = state.CurrentPower(meas).Value
-	val["last_e_export"] = state.EnergyDay(meas).Value / 1000
+func (fc *FromFimpRouter) SendMeasurements(meas *model.Measurements) {
+	counter := fc.state.EnergyCounter(model.CounterPV)
+	val := inverterReport(meas, counter)
+	if fc.publishMeterReport("pt:j1/mt:evt/rt:dev/rn:fronius/ad:1/sv:inverter/ad:1", "inverter", val) {
+		fc.state.MarkEnergyReported(model.CounterPV, counter.Total)
+	}
+	if fc.hasMeter() {
+		fc.sendSelfConsumptionReport(meas)
+		fc.sendHouseLoadReport(meas)
+	}
+	fc.sendDCInputReports(meas)
+	fc.SendHomeAssistantState(meas)
+}
 
-	msg := fimpgo.NewMessage("evt.meter_ext.report", "inverter", "float_map", val, nil, nil, nil)
-	msg.Source = "fronius"
-	adr, _ := fimpgo.NewAddressFromString("pt:j1/mt:evt/rt:dev/rn:fronius/ad:1/sv:inverter/ad:1")
-	fc.mqt.Publish(adr, msg)
-	log.Debug("Energy message sent")
+func (fc *FromFimpRouter) SendHybridMeasurements(meas *model.Measurements) {
+	counter := fc.state.EnergyCounter(model.CounterPV)
+	val := hybridInverterReport(meas, counter)
+	if fc.publishMeterReport("pt:j1/mt:evt/rt:dev/rn:fronius/ad:1/sv:inverter/ad:1", "inverter", val) {
+		fc.state.MarkEnergyReported(model.CounterPV, counter.Total)
+	}
+	fc.sendSelfConsumptionReport(meas)
+	fc.sendHouseLoadReport(meas)
+	fc.sendDCInputReports(meas)
+	fc.SendHomeAssistantState(meas)
+}
+
+// sendSelfConsumptionReport publishes the autonomy and self-consumption of the site, nothing is
+// sent while none of them is known.
+func (fc *FromFimpRouter) sendSelfConsumptionReport(meas *model.Measurements) {
+	val := selfConsumptionReport(meas, fc.dayTotals())
+	if len(val) == 0 {
+		return
+	}
+	fc.publishReport("pt:j1/mt:evt/rt:dev/rn:fronius/ad:1/sv:self_consumption/ad:1", "evt.self_consumption.report", model.SelfConsumptionService, val)
+}
+
+// sendHouseLoadReport publishes the consumption of the house on the meter_elec service.
+func (fc *FromFimpRouter) sendHouseLoadReport(meas *model.Measurements) {
+	counter := fc.state.EnergyCounter(model.CounterLoad)
+	val := houseLoadReport(meas, counter)
+	if len(val) == 0 {
+		return
+	}
+	if fc.publishMeterReport("pt:j1/mt:evt/rt:dev/rn:fronius/ad:1/sv:meter_elec/ad:1", model.HouseLoadService, val) {
+		fc.state.MarkEnergyReported(model.CounterLoad, counter.Total)
+	}
+}
+
+// sendDCInputReports publishes the DC inputs of every inverter on their inverter_solar_conn service.
+func (fc *FromFimpRouter) sendDCInputReports(meas *model.Measurements) {
+	for _, inv := range meas.DevicesOfType(model.DeviceTypeInverter) {
+		for _, input := range inv.DCInputs {
+			address := model.DCInputAddress(inv.ID, input.Index)
+			fc.publishMeterReport("pt:j1/mt:evt/rt:dev/rn:fronius/ad:1/sv:inverter_solar_conn/ad:"+address, "inverter_solar_conn", dcInputReport(input))
+		}
+	}
 }
 
-func (fc *FromFimpRouter) SendHybridMeasurements(meas fronius.Powerflow) {
-	state := fronius.State{}
-	val := make(map[string]float64)
-	val["p_export"] = state.CurrentPowerHybrid(meas).Value
+// publishMeterReport sends an evt.meter_ext.report unless no value moved outside its deadband
+// since the last report on the same topic and the heartbeat hasn't expired yet. It returns true
+// if the report was sent.
+func (fc *FromFimpRouter) publishMeterReport(topic string, service string, val map[string]float64) bool {
+	return fc.publishReport(topic, "evt.meter_ext.report", service, val)
+}
 
-	msg := fimpgo.NewMessage("evt.meter_ext.report", "inverter", "float_map", val, nil, nil, nil)
+// publishReport sends a float_map report of type msgType, filtered like publishMeterReport.
+func (fc *FromFimpRouter) publishReport(topic string, msgType string, service string, val map[string]float64) bool {
+	if !fc.reportFilter.shouldPublish(topic, val, fc.configs) {
+		log.Trace("Energy message within deadband, skipped")
+		return false
+	}
+	msg := fimpgo.NewMessage(msgType, service, "float_map", val, nil, nil, nil)
 	msg.Source = "fronius"
-	adr, _ := fimpgo.NewAddressFromString("pt:j1/mt:evt/rt:dev/rn:fronius/ad:1/sv:inverter/ad:1")
-	fc.mqt.Publish(adr, msg)
+	adr, _ := fimpgo.NewAddressFromString(topic)
+	fc.publish(adr, msg)
 	log.Debug("Energy message sent")
+	return true
+}
+
+// SendInclusionReport publishes the inclusion report matching the configured inverter type.
+func (fc *FromFimpRouter) SendInclusionReport() {
+	var inclReport interface{}
+	dcInputs := dcInputAddresses(fc.state.LatestMeasurements())
+	if fc.configs.Type == model.InverterTypeHybrid {
+		inclReport = model.SendHybridInclusionReport(dcInputs)
+	} else {
+		inclReport = model.SendInclusionReport(fc.hasMeter(), dcInputs)
+	}
+
+	msg := fimpgo.NewMessage("evt.thing.inclusion_report", "fronius", fimpgo.VTypeObject, inclReport, nil, nil, nil)
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "fronius", ResourceAddress: "1"}
+	fc.publish(&adr, msg)
+	fc.reportFilter.reset()
+}
+
+// hasMeter tells if the Datamanager lists a Smart Meter, hybrid sites read it through the powerflow.
+func (fc *FromFimpRouter) hasMeter() bool {
+	return hasMeter(fc.state.KnownDevices())
 }
 
-// things for hybrid inverter
+// dcInputAddresses returns the service addresses of the DC inputs of all inverters.
+func dcInputAddresses(meas *model.Measurements) []string {
+	if meas == nil {
+		return nil
+	}
+	var addresses []string
+	for _, inv := range meas.DevicesOfType(model.DeviceTypeInverter) {
+		for _, input := range inv.DCInputs {
+			addresses = append(addresses, model.DCInputAddress(inv.ID, input.Index))
+		}
+	}
+	return addresses
+}
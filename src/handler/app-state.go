@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"github.com/futurehomeno/fimpgo"
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	"github.com/thingsplex/fronius/model"
+)
+
+// UpdateAppState sets the app state to running when an inverter is configured and to not
+// configured otherwise, a running app polls the inverter. Error and terminating states are kept.
+func (fc *FromFimpRouter) UpdateAppState() {
+	switch fc.appLifecycle.AppState() {
+	case edgeapp.AppStateStartupError, edgeapp.AppStateTerminate:
+		return
+	}
+	state := edgeapp.State(edgeapp.AppStateNotConfigured)
+	if fc.configs.IsConfigured() {
+		state = edgeapp.AppStateRunning
+	}
+	if fc.appLifecycle.AppState() != state {
+		fc.appLifecycle.SetAppState(state, nil)
+	}
+	// started here rather than on the state event, so a change right after startup can't be missed
+	if state == edgeapp.AppStateRunning && fc.poller != nil {
+		fc.poller.Start()
+	}
+}
+
+// PublishAppState publishes the states of the app, e.g. so the hub learns about a shutdown.
+func (fc *FromFimpRouter) PublishAppState() {
+	msg := fimpgo.NewMessage("evt.app.state_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.GetAllStates(), nil, nil, nil)
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+	fc.publish(&adr, msg)
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type BreakerState string
+
+const (
+	// BreakerClosed polls at the normal rate.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen only probes the Datamanager, with exponential backoff.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen polls once after a successful probe, to decide between closed and open.
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// failureSummaryInterval is how often a summary is logged while polls keep failing.
+const failureSummaryInterval = 10 * time.Minute
+
+// BreakerStats are the counters of the circuit breaker around inverter requests.
+type BreakerStats struct {
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	Failures            int          `json:"failures"`
+	Opened              int          `json:"opened"`
+	Probes              int          `json:"probes"`
+	ProbeFailures       int          `json:"probe_failures"`
+	FailingSince        time.Time    `json:"failing_since"`
+}
+
+// circuitBreaker stops polling a Datamanager that keeps failing. While open it's only probed
+// with a cheap request, at an exponentially growing interval.
+type circuitBreaker struct {
+	mux          sync.Mutex
+	stats        BreakerStats
+	lastSummary  time.Time
+	lastError    string
+	failuresSeen int
+	random       *rand.Rand
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{stats: BreakerStats{State: BreakerClosed}, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.stats.State == BreakerOpen
+}
+
+// success records a successful poll and closes the breaker.
+func (b *circuitBreaker) success() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.stats.ConsecutiveFailures > 0 {
+		log.Infof("<poller> Inverter recovered after %d failed polls in %s", b.stats.ConsecutiveFailures, time.Since(b.stats.FailingSince).Round(time.Second))
+	}
+	if b.stats.State != BreakerClosed {
+		log.Info("<poller> Circuit breaker closed")
+	}
+	b.stats.State = BreakerClosed
+	b.stats.ConsecutiveFailures = 0
+	b.stats.FailingSince = time.Time{}
+}
+
+// failure records a failed poll, the breaker opens after openAfter failures in a row or when the
+// poll after a probe fails. Only the first failure and a periodic summary are logged.
+func (b *circuitBreaker) failure(err error, openAfter int) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	now := time.Now()
+	b.stats.Failures++
+	b.stats.ConsecutiveFailures++
+	b.lastError = err.Error()
+	switch {
+	case b.stats.ConsecutiveFailures == 1:
+		b.stats.FailingSince = now
+		b.lastSummary = now
+		b.failuresSeen = 0
+		log.Error("<poller> Can't get measurements - ", err)
+	case now.Sub(b.lastSummary) >= failureSummaryInterval:
+		log.Errorf("<poller> Still failing, %d failed polls since %s, last error: %s",
+			b.stats.ConsecutiveFailures-b.failuresSeen, b.stats.FailingSince.Format(time.RFC3339), b.lastError)
+		b.lastSummary = now
+		b.failuresSeen = b.stats.ConsecutiveFailures
+	default:
+		log.Debug("<poller> Can't get measurements - ", err)
+	}
+	if b.stats.State == BreakerHalfOpen || (b.stats.State == BreakerClosed && b.stats.ConsecutiveFailures >= openAfter) {
+		b.open()
+	}
+}
+
+// probed records the result of a probe while open, a successful probe lets one poll through.
+func (b *circuitBreaker) probed(err error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.stats.Probes++
+	if err != nil {
+		b.stats.ProbeFailures++
+		b.stats.ConsecutiveFailures++
+		b.lastError = err.Error()
+		log.Debug("<poller> Probe failed - ", err)
+		return
+	}
+	log.Debug("<poller> Probe succeeded, circuit breaker half open")
+	b.stats.State = BreakerHalfOpen
+}
+
+func (b *circuitBreaker) open() {
+	if b.stats.State != BreakerOpen {
+		b.stats.Opened++
+		log.Warnf("<poller> Circuit breaker open after %d failed polls, probing the Datamanager with backoff", b.stats.ConsecutiveFailures)
+	}
+	b.stats.State = BreakerOpen
+}
+
+// backoff returns the interval until the next attempt, base doubled with every failure in a row,
+// at most max and with ±20 % jitter so many adapters don't hit the network at the same time.
+func (b *circuitBreaker) backoff(base, max time.Duration) time.Duration {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.stats.ConsecutiveFailures == 0 {
+		return base
+	}
+	exp := math.Min(float64(b.stats.ConsecutiveFailures-1), 30)
+	interval := time.Duration(math.Min(float64(base)*math.Pow(2, exp), float64(max)))
+	jitter := 0.8 + 0.4*b.random.Float64()
+	return time.Duration(float64(interval) * jitter)
+}
+
+func (b *circuitBreaker) statsSnapshot() BreakerStats {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.stats
+}
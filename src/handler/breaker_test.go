@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker()
+	fail := errors.New("timeout")
+
+	b.failure(fail, 3)
+	b.failure(fail, 3)
+	if b.isOpen() {
+		t.Fatal("breaker open before 3 failures")
+	}
+	b.failure(fail, 3)
+	if !b.isOpen() {
+		t.Fatal("breaker closed after 3 failures")
+	}
+	b.probed(fail)
+	if !b.isOpen() {
+		t.Fatal("breaker not open after failed probe")
+	}
+	b.probed(nil)
+	if state := b.statsSnapshot().State; state != BreakerHalfOpen {
+		t.Fatalf("state %s after successful probe", state)
+	}
+	b.failure(fail, 3)
+	if !b.isOpen() {
+		t.Fatal("breaker not open after failed poll in half open state")
+	}
+	b.probed(nil)
+	b.success()
+	stats := b.statsSnapshot()
+	if stats.State != BreakerClosed || stats.ConsecutiveFailures != 0 {
+		t.Errorf("unexpected stats after recovery %+v", stats)
+	}
+	if stats.Opened != 2 || stats.Probes != 3 || stats.ProbeFailures != 1 || stats.Failures != 4 {
+		t.Errorf("unexpected counters %+v", stats)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newCircuitBreaker()
+	base, max := 5*time.Second, time.Minute
+	if d := b.backoff(base, max); d != base {
+		t.Errorf("backoff without failures = %s", d)
+	}
+	for i, want := range []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute} {
+		b.failure(errors.New("timeout"), 100)
+		d := b.backoff(base, max)
+		if d < want*8/10 || d > want*12/10 {
+			t.Errorf("backoff after %d failures = %s, want %s ±20 %%", i+1, d, want)
+		}
+	}
+}
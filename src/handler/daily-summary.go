@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/model"
+)
+
+// SendDailySummary publishes the summary of a finished day with evt.app.daily_summary_report.
+func (fc *FromFimpRouter) SendDailySummary(summary model.DailySummary) {
+	msg := fimpgo.NewMessage("evt.app.daily_summary_report", model.ServiceName, fimpgo.VTypeObject, summary, nil, nil, nil)
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+	fc.publish(&adr, msg)
+}
+
+// respondWithDailySummary answers cmd.app.get_daily_summary with the summary of the latest day
+// the min/max values were read on, usually today so far.
+func (fc *FromFimpRouter) respondWithDailySummary(newMsg *fimpgo.Message, adr *fimpgo.Address) {
+	summary := model.DailySummary{}
+	if dates := fc.state.MinMaxDates(); len(dates) > 0 {
+		summary, _ = fc.state.DailySummary(dates[len(dates)-1])
+	} else {
+		log.Debug("<fimp> No min/max values read yet")
+	}
+	msg := fimpgo.NewMessage("evt.app.daily_summary_report", model.ServiceName, fimpgo.VTypeObject, summary, nil, nil, newMsg.Payload)
+	if err := fc.respond(newMsg.Payload, msg); err != nil {
+		fc.publish(adr, msg)
+	}
+}
@@ -0,0 +1,780 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/futurehomeno/fimpgo"
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	"github.com/futurehomeno/fimpgo/fimptype"
+	"github.com/thingsplex/fronius/handler"
+	"github.com/thingsplex/fronius/model"
+	"github.com/thingsplex/fronius/simulator"
+	"github.com/thingsplex/fronius/utils"
+)
+
+const (
+	deviceEvtTopic  = "pt:j1/mt:evt/rt:dev/rn:fronius/ad:1/#"
+	adapterEvtTopic = "pt:j1/mt:evt/rt:ad/rn:fronius/ad:1"
+	responseTopic   = "pt:j1/mt:rsp/rt:app/rn:e2e/ad:1"
+)
+
+// testSite runs the adapter against a simulated inverter and an embedded broker, and listens
+// to everything the adapter publishes like the hub would.
+type testSite struct {
+	t       *testing.T
+	sim     *simulator.Simulator
+	broker  *simulator.Broker
+	hub     *fimpgo.MqttTransport
+	adapter *fimpgo.MqttTransport
+	router  *handler.FromFimpRouter
+	poller  *handler.Poller
+	states  *model.State
+	stats   *model.Statistics
+	hubCh   fimpgo.MessageCh
+	rawCh   chan rawMessage
+	workDir string
+}
+
+// rawMessage is a message published outside of FIMP, e.g. for Home Assistant.
+type rawMessage struct {
+	topic   string
+	payload []byte
+}
+
+// newTestSite starts a site, configure changes the adapter's configs before polling starts.
+func newTestSite(t *testing.T, inverterType string, site simulator.Site, configure ...func(configs *model.Configs)) *testSite {
+	broker, err := simulator.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testSite{t: t, broker: broker, sim: simulator.New(), hubCh: make(fimpgo.MessageCh, 50), rawCh: make(chan rawMessage, 100)}
+	ts.sim.SetSite(site)
+	ts.workDir = newWorkDir(t)
+
+	configs := model.NewConfigs(ts.workDir)
+	if err := configs.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	configs.Host = ts.sim.Host()
+	configs.Type = inverterType
+	configs.PollTimeSec = model.MinPollTimeSec
+	configs.EnergyPollTimeSec = model.MinPollTimeSec
+	for _, change := range configure {
+		change(configs)
+	}
+	states := model.NewStates(ts.workDir)
+	if err := states.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.hub = fimpgo.NewMqttTransport(broker.URI(), "e2e-hub", "", "", true, 1, 1)
+	if err := ts.hub.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ts.hub.RegisterChannel("e2e", ts.hubCh)
+	ts.hub.Subscribe(deviceEvtTopic)
+	ts.hub.Subscribe(adapterEvtTopic)
+	ts.hub.Subscribe(responseTopic)
+	for _, topic := range []string{"homeassistant/#", "fronius/#"} {
+		ts.hub.Client().Subscribe(topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
+			select {
+			case ts.rawCh <- rawMessage{topic: msg.Topic(), payload: msg.Payload()}:
+			default:
+			}
+		}).Wait()
+	}
+
+	ts.adapter = fimpgo.NewMqttTransport(broker.URI(), "e2e-fronius", "", "", true, 1, 1)
+	if err := ts.adapter.Start(); err != nil {
+		t.Fatal(err)
+	}
+	appLifecycle := edgeapp.NewAppLifecycle()
+	router := handler.NewFromFimpRouter(ts.adapter, appLifecycle, configs, states)
+	poller := handler.NewPoller(configs, states, router, appLifecycle)
+	router.SetPoller(poller)
+	statistics := model.NewStatistics(configs)
+	poller.AddSink(statistics)
+	router.SetStatistics(statistics)
+	gridEvents := model.NewGridEvents(configs)
+	poller.AddSink(handler.NewGridMonitor(router, gridEvents))
+	router.SetGridEvents(gridEvents)
+	router.Start()
+	router.UpdateAppState()
+	ts.router, ts.poller = router, poller
+	ts.states, ts.stats = states, statistics
+	return ts
+}
+
+func (ts *testSite) Close() {
+	ts.poller.Stop()
+	ts.hub.Stop()
+	ts.adapter.Stop()
+	ts.sim.Close()
+	ts.broker.Close()
+	os.RemoveAll(ts.workDir)
+}
+
+// expectRaw waits until something was published on all topics and returns the first payload of each.
+func (ts *testSite) expectRaw(topics ...string) map[string][]byte {
+	ts.t.Helper()
+	received := make(map[string][]byte)
+	timeout := time.After(10 * time.Second)
+	for len(received) < len(topics) {
+		select {
+		case msg := <-ts.rawCh:
+			for _, topic := range topics {
+				if _, ok := received[topic]; !ok && msg.topic == topic {
+					received[topic] = msg.payload
+				}
+			}
+		case <-timeout:
+			ts.t.Fatalf("received only %d of %v", len(received), topics)
+		}
+	}
+	return received
+}
+
+// expect waits for the next message of msgType, skipping everything else.
+func (ts *testSite) expect(msgType string, service string) *fimpgo.Message {
+	ts.t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-ts.hubCh:
+			if msg.Payload.Type == msgType && (service == "" || msg.Payload.Service == service) {
+				return msg
+			}
+		case <-timeout:
+			ts.t.Fatalf("no %s from %s received", msgType, service)
+		}
+	}
+}
+
+func (ts *testSite) request(service, msgType string) {
+	msg := fimpgo.NewNullMessage(msgType, service, nil, nil, nil)
+	msg.ResponseToTopic = responseTopic
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName,
+		ResourceAddress: "1", ServiceName: service, ServiceAddress: "1"}
+	ts.hub.Publish(&adr, msg)
+}
+
+// command sends an adapter command like the hub does. A nil payload is sent as null, a string as
+// str and a map[string]string as str_map, everything else as object.
+func (ts *testSite) command(msgType string, payload interface{}) {
+	var msg *fimpgo.FimpMessage
+	switch val := payload.(type) {
+	case nil:
+		msg = fimpgo.NewNullMessage(msgType, model.ServiceName, nil, nil, nil)
+	case string:
+		msg = fimpgo.NewStringMessage(msgType, model.ServiceName, val, nil, nil, nil)
+	case map[string]string:
+		msg = fimpgo.NewStrMapMessage(msgType, model.ServiceName, val, nil, nil, nil)
+	default:
+		msg = fimpgo.NewObjectMessage(msgType, model.ServiceName, val, nil, nil, nil)
+	}
+	msg.ResponseToTopic = responseTopic
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+	ts.hub.Publish(&adr, msg)
+}
+
+// configure sends conf with cmd.config.extended_set.
+func (ts *testSite) configure(conf model.Configs) {
+	ts.command("cmd.config.extended_set", conf)
+}
+
+func newWorkDir(t *testing.T) string {
+	workDir, err := ioutil.TempDir("", "fronius-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"data", "defaults"} {
+		os.MkdirAll(filepath.Join(workDir, dir), 0755)
+	}
+	for _, file := range []string{"config.json", "state.json", "app-manifest.json"} {
+		src := filepath.Join("..", "..", "testdata", "defaults", file)
+		if err := utils.CopyFile(src, filepath.Join(workDir, "defaults", file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return workDir
+}
+
+func TestNotHybridEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.DefaultSite())
+	defer ts.Close()
+
+	ts.expect("evt.thing.inclusion_report", "")
+	report := ts.expect("evt.meter_ext.report", "inverter")
+	val, err := report.Payload.GetFloatMapValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val["p_export"] != 1604 || val["e_export"] != 27280.602 {
+		t.Errorf("unexpected report %v", val)
+	}
+
+	ts.sim.UpdateSite(func(site *simulator.Site) {
+		site.PowerPV = 2500
+		site.EnergyTotal += 20
+	})
+	report = ts.expect("evt.meter_ext.report", "inverter")
+	val, _ = report.Payload.GetFloatMapValue()
+	if val["p_export"] != 2500 || val["last_e_export"] != 0.02 {
+		t.Errorf("unexpected report after change %v", val)
+	}
+
+	ts.sim.SetScenario(simulator.ScenarioNight)
+	report = ts.expect("evt.meter_ext.report", "inverter")
+	val, _ = report.Payload.GetFloatMapValue()
+	if val["p_export"] != 0 || val["e_export"] != 27280.622 {
+		t.Errorf("unexpected report at night %v", val)
+	}
+
+	ts.request("inverter", "cmd.meter_ext.get_report")
+	report = ts.expect("evt.meter_ext.report", "inverter")
+	if report.Topic != responseTopic {
+		t.Errorf("get_report answered on %s", report.Topic)
+	}
+	val, _ = report.Payload.GetFloatMapValue()
+	if _, ok := val["last_e_export"]; ok || val["e_export"] != 27280.622 {
+		t.Errorf("unexpected get_report answer %v", val)
+	}
+	if n := ts.sim.Requests("/solar_api/v1/GetActiveDeviceInfo.cgi"); n != 1 {
+		t.Errorf("device info read %d times, expected once", n)
+	}
+}
+
+func TestHybridEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeHybrid, simulator.HybridSite())
+	defer ts.Close()
+
+	ts.expect("evt.thing.inclusion_report", "")
+	report := ts.expect("evt.meter_ext.report", "inverter")
+	val, _ := report.Payload.GetFloatMapValue()
+	if val["p_export"] != 4200 {
+		t.Errorf("unexpected report %v", val)
+	}
+
+	ts.request("battery", "cmd.lvl.get_report")
+	lvl, err := ts.expect("evt.lvl.report", "battery").Payload.GetIntValue()
+	if err != nil || lvl != 58 {
+		t.Errorf("battery level = %d, %v", lvl, err)
+	}
+
+	ts.request("inverter_grid_conn", "cmd.meter_ext.get_report")
+	val, _ = ts.expect("evt.meter_ext.report", "inverter_grid_conn").Payload.GetFloatMapValue()
+	if val["p_export"] != 1200 || val["p_import"] != 0 {
+		t.Errorf("unexpected grid report %v", val)
+	}
+
+	ts.request(model.HouseLoadService, "cmd.meter_ext.get_report")
+	val, _ = ts.expect("evt.meter_ext.report", model.HouseLoadService).Payload.GetFloatMapValue()
+	if val["p_import"] != 2400 {
+		t.Errorf("unexpected house load report %v", val)
+	}
+
+	ts.command("cmd.app.get_full_state", nil)
+	state := model.StateReport{}
+	if err := ts.expect("evt.app.full_state_report", "").Payload.GetObjectValue(&state); err != nil {
+		t.Fatal(err)
+	}
+	inverter, ok := state.Devices["inverter:1"]
+	if state.Site == nil || state.LastSuccess.IsZero() || !ok || inverter.Identity == nil || inverter.Measurement == nil || state.Devices["storage:0"].Identity == nil {
+		t.Errorf("unexpected state %+v", state)
+	}
+}
+
+func TestSelfConsumptionEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.MeterSite())
+	defer ts.Close()
+
+	inclusion := fimptype.ThingInclusionReport{}
+	if err := ts.expect("evt.thing.inclusion_report", "").Payload.GetObjectValue(&inclusion); err != nil {
+		t.Fatal(err)
+	}
+	included := false
+	for _, service := range inclusion.Services {
+		included = included || service.Name == model.SelfConsumptionService
+	}
+	if !included {
+		t.Errorf("self_consumption service not included %+v", inclusion.Services)
+	}
+	val, _ := ts.expect("evt.self_consumption.report", model.SelfConsumptionService).Payload.GetFloatMapValue()
+	if val["rel_autonomy"] != 100 || val["rel_self_consumption"] != 62.3 {
+		t.Errorf("unexpected report %v", val)
+	}
+
+	ts.sim.UpdateSite(func(site *simulator.Site) { site.PowerGrid = 500 })
+	val, _ = ts.expect("evt.self_consumption.report", model.SelfConsumptionService).Payload.GetFloatMapValue()
+	if val["rel_autonomy"] != 76.2 || val["rel_self_consumption"] != 100 {
+		t.Errorf("unexpected report while importing %v", val)
+	}
+	if _, ok := val["day_autonomy"]; !ok {
+		t.Errorf("no daily autonomy in %v", val)
+	}
+
+	ts.request(model.SelfConsumptionService, "cmd.self_consumption.get_report")
+	report := ts.expect("evt.self_consumption.report", model.SelfConsumptionService)
+	if report.Topic != responseTopic {
+		t.Errorf("get_report answered on %s", report.Topic)
+	}
+}
+
+func TestHouseLoadEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.MeterSite())
+	defer ts.Close()
+
+	val, _ := ts.expect("evt.meter_ext.report", model.HouseLoadService).Payload.GetFloatMapValue()
+	if val["p_import"] != 1000 || val["e_import"] != 0 {
+		t.Errorf("unexpected report %v", val)
+	}
+
+	ts.sim.UpdateSite(func(site *simulator.Site) { site.PowerGrid = 500 })
+	val, _ = ts.expect("evt.meter_ext.report", model.HouseLoadService).Payload.GetFloatMapValue()
+	if val["p_import"] != 2104 || val["e_import"] <= 0 || val["last_e_import"] != val["e_import"] {
+		t.Errorf("unexpected report after change %v", val)
+	}
+
+	// the meter is still read while the inverter sleeps
+	ts.sim.SetScenario(simulator.ScenarioNight)
+	ts.sim.UpdateSite(func(site *simulator.Site) { site.PowerGrid = 300 })
+	val, _ = ts.expect("evt.meter_ext.report", model.HouseLoadService).Payload.GetFloatMapValue()
+	if val["p_import"] != 300 {
+		t.Errorf("unexpected report at night %v", val)
+	}
+}
+
+func TestStaleReportEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.DefaultSite(), func(configs *model.Configs) {
+		configs.PollTimeSec, configs.EnergyPollTimeSec = 60, 60
+	})
+	defer ts.Close()
+	ts.expect("evt.meter_ext.report", "inverter")
+
+	stale := *ts.states.LatestMeasurements()
+	stale.Timestamp = time.Now().Add(-time.Hour)
+	ts.states.SetMeasurements(&stale)
+	ts.sim.SetDelay(time.Second)
+	requests := ts.sim.Requests("/solar_api/v1/GetInverterRealtimeData.cgi")
+
+	// both reports wait for one poll, the router keeps answering meanwhile
+	ts.request("inverter", "cmd.meter_ext.get_report")
+	ts.request("inverter_grid_conn", "cmd.meter_ext.get_report")
+	ts.command("cmd.app.get_grid_events", nil)
+
+	answered := map[string]bool{}
+	timeout := time.After(10 * time.Second)
+	for len(answered) < 3 {
+		select {
+		case msg := <-ts.hubCh:
+			if msg.Topic != responseTopic {
+				continue
+			}
+			if msg.Payload.Type == "evt.app.grid_events_report" && len(answered) > 0 {
+				t.Error("grid events answered after the reports")
+			}
+			answered[msg.Payload.Type+"/"+msg.Payload.Service] = true
+		case <-timeout:
+			t.Fatalf("only %v answered", answered)
+		}
+	}
+	if polls := ts.sim.Requests("/solar_api/v1/GetInverterRealtimeData.cgi") - requests; polls != 1 {
+		t.Errorf("%d polls for two stale reports", polls)
+	}
+}
+
+func TestNightMeterStatisticsEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.MeterSite(), func(configs *model.Configs) {
+		configs.NightPollTimeSec = 1
+	})
+	defer ts.Close()
+	ts.expect("evt.meter_ext.report", model.HouseLoadService)
+
+	// the house imports 300 W while the inverter sleeps
+	ts.sim.SetScenario(simulator.ScenarioNight)
+	ts.sim.UpdateSite(func(site *simulator.Site) { site.PowerGrid = 300 })
+	ts.expect("evt.meter_ext.report", model.HouseLoadService)
+	day := model.EnergyTotals{}
+	for start := time.Now(); time.Since(start) < 10*time.Second && day.GridImport == 0; time.Sleep(500 * time.Millisecond) {
+		day = ts.stats.Current(model.PeriodDay)
+	}
+	if day.GridImport <= 0 || day.Consumption <= day.Production {
+		t.Fatalf("night import not counted %+v", day)
+	}
+	if autonomy, ok := day.Autonomy(); !ok || autonomy >= 100 {
+		t.Errorf("night import not in the day autonomy %v", autonomy)
+	}
+
+	ts.request(model.SelfConsumptionService, "cmd.self_consumption.get_report")
+	val, _ := ts.expect("evt.self_consumption.report", model.SelfConsumptionService).Payload.GetFloatMapValue()
+	if val["day_autonomy"] >= 100 {
+		t.Errorf("unexpected day autonomy %v", val)
+	}
+
+	// the house consumption counter integrates the same samples as the statistics
+	ts.poller.Stop()
+	day = ts.stats.Current(model.PeriodDay)
+	if load := ts.states.EnergyCounter(model.CounterLoad).Total; math.Abs(load-day.Consumption) > 1e-6 {
+		t.Errorf("house consumption %f Wh, statistics %f Wh", load, day.Consumption)
+	}
+}
+
+func TestDCInputsEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.DefaultSite())
+	defer ts.Close()
+
+	inclusion := fimptype.ThingInclusionReport{}
+	if err := ts.expect("evt.thing.inclusion_report", "").Payload.GetObjectValue(&inclusion); err != nil {
+		t.Fatal(err)
+	}
+	var addresses []string
+	for _, service := range inclusion.Services {
+		if service.Name == "inverter_solar_conn" {
+			addresses = append(addresses, service.Address)
+		}
+	}
+	if len(addresses) != 2 || addresses[1] != "/rt:dev/rn:fronius/ad:1/sv:inverter_solar_conn/ad:1_2" {
+		t.Errorf("unexpected DC input services %v", addresses)
+	}
+
+	received := map[string]map[string]float64{}
+	for len(received) < 2 {
+		msg := ts.expect("evt.meter_ext.report", "inverter_solar_conn")
+		received[msg.Addr.ServiceAddress], _ = msg.Payload.GetFloatMapValue()
+	}
+	if received["1_1"]["dc_u"] != 412.3 || received["1_2"]["dc_i"] != 0.35 {
+		t.Errorf("unexpected DC input reports %v", received)
+	}
+	// the AC and DC values of the inverter come from CommonInverterData, not from Scope=System
+	inverter := ts.states.LatestMeasurements().DevicesOfType(model.DeviceTypeInverter)[0]
+	if inverter.VoltageAC != 231.4 || inverter.Frequency != 49.98 || inverter.VoltageDC != 412.3 || inverter.CurrentDC != 4.11 {
+		t.Errorf("unexpected inverter values %+v", inverter)
+	}
+
+	ts.request("inverter_solar_conn", "cmd.meter_ext.get_report")
+	val, _ := ts.expect("evt.meter_ext.report", "inverter_solar_conn").Payload.GetFloatMapValue()
+	if val["p_export"] != 1604 {
+		t.Errorf("site production expected on address 1, got %v", val)
+	}
+}
+
+func TestDailySummaryEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.DefaultSite())
+	defer ts.Close()
+	ts.expect("evt.meter_ext.report", "inverter")
+
+	ts.command("cmd.app.get_daily_summary", nil)
+	summary := model.DailySummary{}
+	if err := ts.expect("evt.app.daily_summary_report", "").Payload.GetObjectValue(&summary); err != nil {
+		t.Fatal(err)
+	}
+	today := time.Now().Format(model.DateLayout)
+	inverter := summary.Inverters["1"]
+	if summary.Date != today || summary.Site.PowerMax != 3821 || inverter.Year.PowerMax != 5012 || inverter.Day.VoltageACMax != 240.1 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+
+	// the summary of the day is published when the inverter goes to sleep
+	ts.sim.SetScenario(simulator.ScenarioNight)
+	summary = model.DailySummary{}
+	if err := ts.expect("evt.app.daily_summary_report", "").Payload.GetObjectValue(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Date != today || summary.EnergyDay != 8190 || summary.Site.VoltageDCMax != 473.3 {
+		t.Errorf("unexpected summary at night %+v", summary)
+	}
+}
+
+func TestGridEventEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.DefaultSite())
+	defer ts.Close()
+	ts.expect("evt.meter_ext.report", "inverter")
+
+	ts.sim.UpdateSite(func(site *simulator.Site) { site.VoltageAC = 258.3 })
+	event := model.GridEvent{}
+	if err := ts.expect("evt.app.grid_event_report", "").Payload.GetObjectValue(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Kind != model.GridOvervoltage || event.Source != "inverter:1" || !event.Active || event.Extreme != 258.3 || event.Limit != 253 {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	ts.sim.UpdateSite(func(site *simulator.Site) { site.VoltageAC = 231.4 })
+	event = model.GridEvent{}
+	if err := ts.expect("evt.app.grid_event_report", "").Payload.GetObjectValue(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Kind != model.GridOvervoltage || event.Active || event.End.Before(event.Start) {
+		t.Fatalf("unexpected end of event %+v", event)
+	}
+
+	ts.command("cmd.app.get_grid_events", nil)
+	report := model.GridEventsReport{}
+	if err := ts.expect("evt.app.grid_events_report", "").Payload.GetObjectValue(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Events) != 1 || report.Events[0].Extreme != 258.3 || report.Limits.FrequencyMax != 50.5 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestNightGridEventEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.MeterSite(), func(configs *model.Configs) {
+		configs.NightPollTimeSec = 1
+	})
+	defer ts.Close()
+	ts.expect("evt.meter_ext.report", model.HouseLoadService)
+
+	// the meter keeps measuring the grid while the inverter sleeps
+	ts.sim.SetScenario(simulator.ScenarioNight)
+	ts.expect("evt.meter_ext.report", model.HouseLoadService)
+	ts.sim.UpdateSite(func(site *simulator.Site) { site.Frequency = 50.8 })
+	event := model.GridEvent{}
+	if err := ts.expect("evt.app.grid_event_report", "").Payload.GetObjectValue(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Kind != model.GridOverfrequency || event.Source != "meter" || !event.Active || event.Extreme != 50.8 {
+		t.Errorf("unexpected event at night %+v", event)
+	}
+}
+
+func TestBatteryCommandEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeHybrid, simulator.HybridSite())
+	defer ts.Close()
+
+	ts.command("cmd.system.forced_battery_storage", nil)
+	ts.expect("evt.app.config_action_report", "")
+
+	writes := ts.sim.ConfigWrites()
+	if len(writes) != 1 || writes[0].Path != "/config/batteries" {
+		t.Fatalf("unexpected config writes %+v", writes)
+	}
+}
+
+func TestReconfigureEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.HybridSite())
+	defer ts.Close()
+	ts.expect("evt.thing.inclusion_report", "")
+
+	ts.configure(model.Configs{Host: "not a host", Type: model.InverterTypeHybrid})
+	report := model.ConfigReport{}
+	if err := ts.expect("evt.app.config_report", "").Payload.GetObjectValue(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.OpStatus != "error" || report.ErrorText == "" {
+		t.Errorf("invalid config accepted %+v", report)
+	}
+
+	ts.configure(model.Configs{Host: ts.sim.Host(), Type: model.InverterTypeHybrid})
+	ts.expect("evt.thing.exclusion_report", "")
+	incl := fimptype.ThingInclusionReport{}
+	if err := ts.expect("evt.thing.inclusion_report", "").Payload.GetObjectValue(&incl); err != nil {
+		t.Fatal(err)
+	}
+	hasBattery := false
+	for _, service := range incl.Services {
+		hasBattery = hasBattery || service.Name == "battery"
+	}
+	if !hasBattery {
+		t.Errorf("inclusion report after type change has no battery service")
+	}
+}
+
+func TestConfigureLaterEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.DefaultSite(), func(configs *model.Configs) {
+		configs.Host = "host_ip"
+	})
+	defer ts.Close()
+
+	// the app starts without an inverter, polling starts once one is configured
+	ts.configure(model.Configs{Host: ts.sim.Host(), Type: model.InverterTypeNotHybrid})
+	ts.expect("evt.app.config_report", "")
+	ts.expect("evt.thing.inclusion_report", "")
+	ts.expect("evt.meter_ext.report", "inverter")
+}
+
+func TestConfigReportsEndToEnd(t *testing.T) {
+	const (
+		apiToken    = "api-token-not-for-the-hub"
+		influxToken = "influx-token-not-for-the-hub"
+	)
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.DefaultSite(), func(configs *model.Configs) {
+		configs.APIToken = apiToken
+		configs.Influx.Token = influxToken
+	})
+	defer ts.Close()
+	ts.expect("evt.meter_ext.report", "inverter")
+
+	// everyone on the broker can read the config reports
+	check := func(msg *fimpgo.Message) {
+		body := msg.Payload.GetRawObjectValue()
+		if strings.Contains(string(body), apiToken) {
+			t.Errorf("%s has the api_token", msg.Payload.Type)
+		}
+		if strings.Contains(string(body), influxToken) {
+			t.Errorf("%s has the InfluxDB token", msg.Payload.Type)
+		}
+		if !strings.Contains(string(body), ts.sim.Host()) {
+			t.Errorf("%s has no host", msg.Payload.Type)
+		}
+	}
+	ts.command("cmd.config.get_extended_report", nil)
+	check(ts.expect("evt.config.extended_report", ""))
+	ts.command("cmd.app.get_manifest", "manifest_state")
+	check(ts.expect("evt.app.manifest_report", ""))
+}
+
+func TestHostChangeEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.DefaultSite())
+	defer ts.Close()
+	ts.expect("evt.meter_ext.report", "inverter")
+
+	// another Datamanager whose lifetime counter is far ahead of the old one
+	other := simulator.New()
+	defer other.Close()
+	site := simulator.DefaultSite()
+	site.EnergyTotal += 5e6
+	other.SetSite(site)
+	ts.configure(model.Configs{Host: other.Host(), Type: model.InverterTypeNotHybrid})
+	ts.expect("evt.app.config_report", "")
+	ts.expect("evt.meter_ext.report", "inverter")
+
+	counter := ts.states.EnergyCounter(model.CounterPV)
+	if counter.Total != site.EnergyTotal || counter.Unreported() != 0 {
+		t.Errorf("counter doesn't start over on the new host %+v", counter)
+	}
+}
+
+func TestShutdownEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.DefaultSite())
+	defer ts.Close()
+	ts.expect("evt.meter_ext.report", "inverter")
+
+	// shutdown order of the service, commands arriving meanwhile are ignored
+	ts.router.Stop()
+	ts.poller.Stop()
+	ts.configure(model.Configs{Host: ts.sim.Host(), Type: model.InverterTypeHybrid})
+	timeout := time.After(500 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case msg := <-ts.hubCh:
+			if msg.Payload.Type == "evt.app.config_report" {
+				t.Fatal("config applied after the router stopped")
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if ts.poller.Stop() {
+		t.Error("poller started again during shutdown")
+	}
+}
+
+func TestConnectivityEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeNotHybrid, simulator.DefaultSite(), func(configs *model.Configs) {
+		configs.MaxBackoffSec = model.MinPollTimeSec
+	})
+	defer ts.Close()
+
+	// every change is one report for thing 1 that lists the devices
+	report := func() map[string]string {
+		msg := ts.expect("evt.thing.connectivity_report", "")
+		val, err := msg.Payload.GetStrMapValue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Addr.ResourceAddress != "1" || val["address"] != "1" {
+			t.Errorf("connectivity report on %s for address %s", msg.Topic, val["address"])
+		}
+		return val
+	}
+	r := report()
+	if r["status"] != handler.ConnectivityUp || r["breaker_state"] != string(handler.BreakerClosed) {
+		t.Errorf("connectivity %v after first poll", r)
+	}
+	if !strings.Contains(r["devices"], "inverter:1=28136344") {
+		t.Errorf("inverter not listed in %q", r["devices"])
+	}
+	ts.sim.SetScenario(simulator.ScenarioError)
+	if r := report(); r["status"] != handler.ConnectivityDown || r["breaker_state"] != string(handler.BreakerOpen) || r["breaker_opened"] != "1" {
+		t.Errorf("connectivity %v while the inverter fails", r)
+	}
+	ts.sim.SetScenario(simulator.ScenarioNormal)
+	if r := report(); r["status"] != handler.ConnectivityUp || r["breaker_state"] != string(handler.BreakerClosed) {
+		t.Errorf("connectivity %v after recovery", r)
+	}
+	if ts.sim.Requests("/solar_api/GetAPIVersion.cgi") == 0 {
+		t.Error("Datamanager wasn't probed while failing")
+	}
+	if stats := ts.poller.Breaker(); stats.State != handler.BreakerClosed || stats.Opened != 1 {
+		t.Errorf("unexpected breaker stats %+v", stats)
+	}
+}
+
+func TestHomeAssistantEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeHybrid, simulator.HybridSite(), func(configs *model.Configs) {
+		configs.HomeAssistantEnabled = true
+	})
+	defer ts.Close()
+
+	const (
+		socConfig    = "homeassistant/sensor/fronius_1_battery/soc/config"
+		energyConfig = "homeassistant/sensor/fronius_1_inverter/energy/config"
+	)
+	received := ts.expectRaw(socConfig, energyConfig, "fronius/1/battery", "fronius/1/meter")
+	config := map[string]interface{}{}
+	json.Unmarshal(received[socConfig], &config)
+	if config["device_class"] != "battery" || config["unit_of_measurement"] != "%" || config["state_topic"] != "fronius/1/battery" {
+		t.Errorf("unexpected battery config %v", config)
+	}
+	config = map[string]interface{}{}
+	json.Unmarshal(received[energyConfig], &config)
+	device, _ := config["device"].(map[string]interface{})
+	if config["state_class"] != "total_increasing" || device["serial_number"] != "31234567" {
+		t.Errorf("unexpected energy config %v", config)
+	}
+	state := map[string]float64{}
+	json.Unmarshal(received["fronius/1/battery"], &state)
+	if state["soc"] != 58 {
+		t.Errorf("unexpected battery state %v", state)
+	}
+	state = map[string]float64{}
+	json.Unmarshal(received["fronius/1/meter"], &state)
+	if state["export_power"] != 1200 || state["import_power"] != 0 {
+		t.Errorf("unexpected meter state %v", state)
+	}
+}
+
+func TestStatisticsEndToEnd(t *testing.T) {
+	ts := newTestSite(t, model.InverterTypeHybrid, simulator.HybridSite())
+	defer ts.Close()
+	ts.expect("evt.meter_ext.report", "inverter")
+	ts.sim.UpdateSite(func(site *simulator.Site) {
+		site.EnergyTotal += 200
+	})
+	ts.expect("evt.meter_ext.report", "inverter")
+
+	query := func(params map[string]string) model.StatisticsReport {
+		ts.command("cmd.app.get_statistics", params)
+		report := model.StatisticsReport{}
+		if err := ts.expect("evt.app.statistics_report", "").Payload.GetObjectValue(&report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	report := query(map[string]string{"period": "hour"})
+	if report.Error != "" || len(report.Periods) == 0 || report.Total.Production != 200 || !report.Total.Metered {
+		t.Errorf("unexpected statistics %+v", report)
+	}
+	if report = query(map[string]string{"period": "day", "from": "yesterday"}); report.Error == "" {
+		t.Error("invalid date accepted")
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"net/http"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/futurehomeno/fimpgo"
 	"github.com/futurehomeno/fimpgo/edgeapp"
@@ -19,12 +21,25 @@ import (
 )
 
 type FromFimpRouter struct {
-	inboundMsgCh fimpgo.MessageCh
-	mqt          *fimpgo.MqttTransport
-	instanceID   string
-	appLifecycle *edgeapp.Lifecycle
-	configs      *model.Configs
-	state        *model.State
+	inboundMsgCh  fimpgo.MessageCh
+	mqt           *fimpgo.MqttTransport
+	instanceID    string
+	appLifecycle  *edgeapp.Lifecycle
+	configs       *model.Configs
+	state         *model.State
+	reportFilter  *reportFilter
+	poller        *Poller
+	statistics    *model.Statistics
+	gridEvents    *model.GridEvents
+	homeAssistant *homeAssistant
+	configMux     sync.RWMutex
+	publishedMux  sync.Mutex
+	published     map[string]uint64
+	// get_report commands waiting for a poll
+	pendingMux     sync.Mutex
+	pendingReports []*fimpgo.Message
+	stopCh         chan struct{}
+	doneCh         chan struct{}
 }
 
 type ListReportRecord struct {
@@ -35,11 +50,17 @@ type ListReportRecord struct {
 }
 
 func NewFromFimpRouter(mqt *fimpgo.MqttTransport, appLifecycle *edgeapp.Lifecycle, configs *model.Configs, states *model.State) *FromFimpRouter {
-	fc := FromFimpRouter{inboundMsgCh: make(fimpgo.MessageCh, 5), mqt: mqt, appLifecycle: appLifecycle, configs: configs, state: states}
+	fc := FromFimpRouter{inboundMsgCh: make(fimpgo.MessageCh, 5), mqt: mqt, appLifecycle: appLifecycle, configs: configs, state: states, reportFilter: newReportFilter(), published: make(map[string]uint64), homeAssistant: newHomeAssistant(),
+		stopCh: make(chan struct{}), doneCh: make(chan struct{})}
 	fc.mqt.RegisterChannel("ch1", fc.inboundMsgCh)
 	return &fc
 }
 
+// SetPoller gives the router access to the poller, so get_report commands can trigger a poll.
+func (fc *FromFimpRouter) SetPoller(poller *Poller) {
+	fc.poller = poller
+}
+
 func (fc *FromFimpRouter) Start() {
 
 	fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:dev/rn:%s/ad:1/#", model.ServiceName))
@@ -48,15 +69,26 @@ func (fc *FromFimpRouter) Start() {
 	log.Debug(fmt.Sprintf("Subscribing to topic: pt:j1/+/rt:ad/rn:%s/ad:1", model.ServiceName))
 
 	go func(msgChan fimpgo.MessageCh) {
+		defer close(fc.doneCh)
 		for {
 			select {
 			case newMsg := <-msgChan:
 				fc.routeFimpMessage(newMsg)
+			case <-fc.stopCh:
+				return
 			}
 		}
 	}(fc.inboundMsgCh)
 }
 
+// Stop stops routing messages and waits until the one being handled is done, so no command
+// reconfigures or starts the poller while the adapter shuts down.
+func (fc *FromFimpRouter) Stop() {
+	fc.mqt.UnregisterChannel("ch1")
+	close(fc.stopCh)
+	<-fc.doneCh
+}
+
 func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 
 	log.Debug("New fimp msg")
@@ -79,127 +111,82 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 		}
 		if mode == "manifest_state" {
 			manifest.AppState = fc.appLifecycle.GetAllStates()
-			manifest.ConfigState = fc.configs
+			manifest.ConfigState = fc.redactedConfigs()
 		}
 		msg := fimpgo.NewMessage("evt.app.manifest_report", model.ServiceName, fimpgo.VTypeObject, manifest, nil, nil, newMsg.Payload)
-		if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
+		if err := fc.respond(newMsg.Payload, msg); err != nil {
 			// if response topic is not set , sending back to default application event topic
-			fc.mqt.Publish(adr, msg)
+			fc.publish(adr, msg)
 		}
 
 	case "cmd.app.get_state":
 		msg := fimpgo.NewMessage("evt.app.manifest_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.GetAllStates(), nil, nil, newMsg.Payload)
-		if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
+		if err := fc.respond(newMsg.Payload, msg); err != nil {
 			// if response topic is not set , sending back to default application event topic
-			fc.mqt.Publish(adr, msg)
+			fc.publish(adr, msg)
+		}
+
+	case "cmd.app.get_full_state":
+		msg := fimpgo.NewMessage("evt.app.full_state_report", model.ServiceName, fimpgo.VTypeObject, fc.state.Report(), nil, nil, newMsg.Payload)
+		if err := fc.respond(newMsg.Payload, msg); err != nil {
+			fc.publish(adr, msg)
 		}
 
+	case "cmd.app.get_statistics":
+		fc.respondWithStatistics(newMsg, adr)
+
+	case "cmd.app.get_daily_summary":
+		fc.respondWithDailySummary(newMsg, adr)
+
+	case "cmd.app.get_grid_events":
+		fc.respondWithGridEvents(newMsg, adr)
+
 	case "cmd.config.get_extended_report":
 
-		msg := fimpgo.NewMessage("evt.config.extended_report", model.ServiceName, fimpgo.VTypeObject, fc.configs, nil, nil, newMsg.Payload)
-		if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-			fc.mqt.Publish(adr, msg)
+		msg := fimpgo.NewMessage("evt.config.extended_report", model.ServiceName, fimpgo.VTypeObject, fc.redactedConfigs(), nil, nil, newMsg.Payload)
+		if err := fc.respond(newMsg.Payload, msg); err != nil {
+			fc.publish(adr, msg)
 		}
 
 	case "cmd.config.extended_set":
 		conf := model.Configs{}
 		err := newMsg.Payload.GetObjectValue(&conf)
 		if err != nil {
-			// TODO: This is an example . Add your logic here or remove
 			log.Error("Can't parse configuration object")
 			return
 		}
-		fc.configs.Host = conf.Host
-		fc.configs.Type = conf.Type
-		fc.configs.Value1 = conf.Value1
-		fc.configs.Value2 = conf.Value2
-		fc.configs.SaveToFile()
-		log.Debugf("App reconfigured . New parameters : %v", fc.configs)
-		// TODO: This is an example . Add your logic here or remove
-		configReport := model.ConfigReport{
-			OpStatus: "ok",
-			AppState: fc.appLifecycle.GetAllStates(),
+		configReport := model.ConfigReport{OpStatus: "ok"}
+		if err := fc.applyConfig(conf); err != nil {
+			log.Error("<fimp> Configuration rejected: ", err)
+			configReport.OpStatus = "error"
+			configReport.ErrorText = err.Error()
+		} else {
+			log.Debugf("App reconfigured . New parameters : %v", fc.configs)
 		}
+		configReport.AppState = fc.appLifecycle.GetAllStates()
 		msg := fimpgo.NewMessage("evt.app.config_report", model.ServiceName, fimpgo.VTypeObject, configReport, nil, nil, newMsg.Payload)
-		if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-			fc.mqt.Publish(adr, msg)
+		if err := fc.respond(newMsg.Payload, msg); err != nil {
+			fc.publish(adr, msg)
 		}
 
-	case "cmd.system.forced_battery_storage_prestart":
-		url := "http://" + fc.configs.Host
-		digestPost(url, "/config/batteries", []byte("{\"HYB_EVU_CHARGEFROMGRID\":true}"))
-		digestPost(url, "/config/batteries", []byte("{\"HYB_EM_POWER\":-50000,\"HYB_EM_MODE\":1}"))
-		val := model.ButtonActionResponse{
-			Operation:       "cmd.system.forced_battery_storage_prestart",
-			OperationStatus: "ok",
-			Next:            "reload",
-			ErrorCode:       "",
-			ErrorText:       "",
-		}
-		msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-		if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-			fc.mqt.Publish(adr, msg)
-		}
+	case "cmd.meter_ext.get_report", "cmd.mode.get_report", "cmd.lvl.get_report", "cmd.self_consumption.get_report":
+		fc.respondWithReport(newMsg)
 
-	case "cmd.system.forced_battery_storage":
-		url := "http://" + fc.configs.Host
-		digestPost(url, "/config/batteries", []byte("{\"HYB_EM_POWER\":50000,\"HYB_EM_MODE\":1}"))
+	case "cmd.system.forced_battery_storage_prestart", "cmd.system.forced_battery_storage", "cmd.system.forced_battery_storage_finished",
+		"cmd.system.excess_solar_production_disabled", "cmd.system.excess_solar_production_enabled":
 		val := model.ButtonActionResponse{
-			Operation:       "cmd.system.forced_battery_storage",
+			Operation:       newMsg.Payload.Type,
 			OperationStatus: "ok",
 			Next:            "reload",
-			ErrorCode:       "",
-			ErrorText:       "",
 		}
-		msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-		if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-			fc.mqt.Publish(adr, msg)
-		}
-
-	case "cmd.system.forced_battery_storage_finished":
-		url := "http://" + fc.configs.Host
-		digestPost(url, "/config/batteries", []byte("{\"HYB_EVU_CHARGEFROMGRID\":false}"))
-		digestPost(url, "/config/batteries", []byte("{\"HYB_EM_POWER\":0,\"HYB_EM_MODE\":1}"))
-		val := model.ButtonActionResponse{
-			Operation:       "cmd.system.forced_battery_storage_finished",
-			OperationStatus: "ok",
-			Next:            "reload",
-			ErrorCode:       "",
-			ErrorText:       "",
+		if err := fc.RunSystemAction(strings.TrimPrefix(newMsg.Payload.Type, "cmd.system.")); err != nil {
+			log.Error("<fimp> ", err)
+			val.OperationStatus = "error"
+			val.ErrorText = err.Error()
 		}
 		msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-		if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-			fc.mqt.Publish(adr, msg)
-		}
-
-	case "cmd.system.excess_solar_production_disabled":
-		url := "http://" + fc.configs.Host
-		digestPost(url, "/config/exportlimit", []byte("{\"DPL_ON\":true,\"DPL_WPEAK\":5000,\"DPL_WLIM_USE_ABS\":true,\"DPL_WLIM_ABS\":0}"))
-		val := model.ButtonActionResponse{
-			Operation:       "cmd.system.excess_solar_production_disabled",
-			OperationStatus: "ok",
-			Next:            "reload",
-			ErrorCode:       "",
-			ErrorText:       "",
-		}
-		msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-		if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-			fc.mqt.Publish(adr, msg)
-		}
-
-	case "cmd.system.excess_solar_production_enabled":
-		url := "http://" + fc.configs.Host
-		digestPost(url, "/config/exportlimit", []byte("{\"DPL_ON\":false}"))
-		val := model.ButtonActionResponse{
-			Operation:       "cmd.system.excess_solar_production_enabled",
-			OperationStatus: "ok",
-			Next:            "reload",
-			ErrorCode:       "",
-			ErrorText:       "",
-		}
-		msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-		if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-			fc.mqt.Publish(adr, msg)
+		if err := fc.respond(newMsg.Payload, msg); err != nil {
+			fc.publish(adr, msg)
 		}
 
 	case "cmd.log.set_level":
@@ -211,26 +198,19 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 		logLevel, err := log.ParseLevel(level)
 		if err == nil {
 			log.SetLevel(logLevel)
-			fc.configs.LogLevel = level
-			fc.configs.SaveToFile()
+			fc.withPollerStopped(func() {
+				fc.configs.LogLevel = level
+				if err := fc.configs.SaveToFile(); err != nil {
+					log.Error("<fimp> Can't save configs. Error: ", err)
+				}
+			})
 		}
 		log.Info("Log level updated to = ", logLevel)
 
 	case "cmd.network.get_all_nodes":
 		// TODO: This is an example . Add your logic here or remove
-	case "cmd.thing.get_inclusion_report":
-		inclReport := model.SendInclusionReport()
-
-		msg := fimpgo.NewMessage("evt.thing.inclusion_report", "fronius", fimpgo.VTypeObject, inclReport, nil, nil, nil)
-		adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "fronius", ResourceAddress: "1"}
-		fc.mqt.Publish(&adr, msg)
-
-	case "cmd.thing.inclusion":
-		inclReport := model.SendInclusionReport()
-
-		msg := fimpgo.NewMessage("evt.thing.inclusion_report", "fronius", fimpgo.VTypeObject, inclReport, nil, nil, nil)
-		adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "fronius", ResourceAddress: "1"}
-		fc.mqt.Publish(&adr, msg)
+	case "cmd.thing.get_inclusion_report", "cmd.thing.inclusion":
+		fc.SendInclusionReport()
 
 	case "cmd.app.uninstall":
 		val := map[string]interface{}{
@@ -239,7 +219,7 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 		msg := fimpgo.NewMessage("evt.thing.exclusion_report", "fronius", fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
 		msg.Source = "fronius"
 		adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "fronius", ResourceAddress: "1"}
-		fc.mqt.Publish(&adr, msg)
+		fc.publish(&adr, msg)
 
 	case "cmd.thing.delete":
 		// remove device from network
@@ -248,8 +228,11 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			log.Error("Wrong msg format")
 			return
 		}
-		fc.configs.Host = "host_ip"
-		fc.appLifecycle.SetConfigState(edgeapp.ConfigStateNotConfigured)
+		fc.withPollerStopped(func() {
+			fc.configs.Host = "host_ip"
+			fc.appLifecycle.SetConfigState(edgeapp.ConfigStateNotConfigured)
+		})
+		fc.UpdateAppState()
 		deviceId, ok := val["address"]
 		if ok {
 			log.Info("Deleting device")
@@ -258,7 +241,7 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 
 			msg := fimpgo.NewMessage("evt.thing.exclusion_report", "fronius", fimpgo.VTypeObject, exclReport, nil, nil, nil)
 			adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "fronius", ResourceAddress: "1"}
-			fc.mqt.Publish(&adr, msg)
+			fc.publish(&adr, msg)
 		} else {
 			log.Error("Incorrect address")
 
@@ -272,14 +255,15 @@ func digestPost(host string, uri string, postBody []byte) bool {
 	method := "POST"
 	req, err := http.NewRequest(method, url, nil)
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	client := &http.Client{Timeout: model.DefaultRequestTimeoutSec * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		log.Error("<fimp> Can't reach the Datamanager. Error: ", err)
+		return false
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusUnauthorized {
-		log.Debug("Recieved status code '%v' auth skipped", resp.StatusCode)
+		log.Debugf("Recieved status code '%v' auth skipped", resp.StatusCode)
 		return true
 	}
 	log.Debug("digestparts")
@@ -297,7 +281,8 @@ func digestPost(host string, uri string, postBody []byte) bool {
 
 	resp, err = client.Do(req)
 	if err != nil {
-		log.Debug("error1: ", err)
+		log.Error("<fimp> Can't reach the Datamanager. Error: ", err)
+		return false
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/model"
+)
+
+// GridMonitor checks the published measurements for grid voltage and frequency excursions and
+// publishes evt.app.grid_event_report when one starts and when it ends.
+type GridMonitor struct {
+	router *FromFimpRouter
+	events *model.GridEvents
+}
+
+func NewGridMonitor(router *FromFimpRouter, events *model.GridEvents) *GridMonitor {
+	return &GridMonitor{router: router, events: events}
+}
+
+func (m *GridMonitor) Add(measurements *model.Measurements) {
+	for _, event := range m.events.Check(measurements) {
+		if event.Active {
+			log.Warnf("<poller> Grid %s at %s, %.2f %s beyond the limit of %.2f %s", event.Kind, event.Source, event.Extreme, event.Unit, event.Limit, event.Unit)
+		} else {
+			log.Infof("<poller> Grid %s at %s ended after %.0fs, extreme %.2f %s", event.Kind, event.Source, event.Duration, event.Extreme, event.Unit)
+		}
+		m.router.SendGridEvent(event)
+	}
+}
+
+// SetGridEvents gives the router access to the grid event log, so it can be queried.
+func (fc *FromFimpRouter) SetGridEvents(events *model.GridEvents) {
+	fc.gridEvents = events
+}
+
+// SendGridEvent publishes a grid event that started or ended with evt.app.grid_event_report.
+func (fc *FromFimpRouter) SendGridEvent(event model.GridEvent) {
+	msg := fimpgo.NewMessage("evt.app.grid_event_report", model.ServiceName, fimpgo.VTypeObject, event, nil, nil, nil)
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+	fc.publish(&adr, msg)
+}
+
+// respondWithGridEvents answers cmd.app.get_grid_events. The request is a null or a str_map with
+// optional from and to, without them all kept events are reported.
+func (fc *FromFimpRouter) respondWithGridEvents(newMsg *fimpgo.Message, adr *fimpgo.Address) {
+	report, err := fc.queryGridEvents(newMsg.Payload)
+	if err != nil {
+		log.Warn("<fimp> Grid event query rejected: ", err)
+		report.Error = err.Error()
+	}
+	msg := fimpgo.NewMessage("evt.app.grid_events_report", model.ServiceName, fimpgo.VTypeObject, report, nil, nil, newMsg.Payload)
+	if err := fc.respond(newMsg.Payload, msg); err != nil {
+		fc.publish(adr, msg)
+	}
+}
+
+func (fc *FromFimpRouter) queryGridEvents(request *fimpgo.FimpMessage) (model.GridEventsReport, error) {
+	if fc.gridEvents == nil {
+		return model.GridEventsReport{}, fmt.Errorf("grid quality isn't monitored")
+	}
+	params := map[string]string{}
+	if request.ValueType == fimpgo.VTypeStrMap {
+		var err error
+		if params, err = request.GetStrMapValue(); err != nil {
+			return model.GridEventsReport{}, err
+		}
+	}
+	from, to := time.Time{}, time.Now().Add(time.Minute)
+	var err error
+	if params["from"] != "" {
+		if from, err = parseStatisticsDate(params["from"]); err != nil {
+			return model.GridEventsReport{}, err
+		}
+	}
+	if params["to"] != "" {
+		if to, err = parseStatisticsDate(params["to"]); err != nil {
+			return model.GridEventsReport{}, err
+		}
+	}
+	return fc.gridEvents.Query(from, to), nil
+}
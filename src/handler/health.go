@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/model"
+)
+
+const (
+	ConnectivityUp   = "UP"
+	ConnectivityDown = "DOWN"
+)
+
+// Health is a snapshot of the connection to the inverter.
+type Health struct {
+	Connected           bool      `json:"connected"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error"`
+}
+
+// healthMonitor tracks poll results and keeps the connection state of the app up to date.
+// The inverter is offline after configs.OfflineAfter() failed polls in a row and online again
+// with the next successful poll.
+type healthMonitor struct {
+	mux          sync.Mutex
+	health       Health
+	reported     bool
+	appLifecycle *edgeapp.Lifecycle
+}
+
+func newHealthMonitor(appLifecycle *edgeapp.Lifecycle) *healthMonitor {
+	return &healthMonitor{appLifecycle: appLifecycle}
+}
+
+// reset is called when polling starts, connectivity is reported again after the first poll.
+// lastSuccess is the last successful poll before, from the persisted state.
+func (h *healthMonitor) reset(lastSuccess time.Time) {
+	h.mux.Lock()
+	if lastSuccess.After(h.health.LastSuccess) {
+		h.health.LastSuccess = lastSuccess
+	}
+	h.health.ConsecutiveFailures = 0
+	h.reported = false
+	h.mux.Unlock()
+}
+
+// success records a successful poll and returns true if the inverter came online.
+func (h *healthMonitor) success(at time.Time) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	changed := !h.health.Connected || !h.reported
+	h.health.Connected = true
+	h.health.ConsecutiveFailures = 0
+	h.health.LastSuccess = at
+	h.health.LastError = ""
+	h.reported = true
+	if changed {
+		h.appLifecycle.SetConnectionState(edgeapp.ConnStateConnected)
+	}
+	return changed
+}
+
+// failure records a failed poll and returns true if the inverter went offline.
+func (h *healthMonitor) failure(err error, offlineAfter int) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.health.ConsecutiveFailures++
+	h.health.LastError = err.Error()
+	if h.health.ConsecutiveFailures < offlineAfter || (!h.health.Connected && h.reported) {
+		return false
+	}
+	h.health.Connected = false
+	h.reported = true
+	h.appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+	return true
+}
+
+func (h *healthMonitor) status() Health {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.health
+}
+
+// SendConnectivityReport tells the hub if the inverter can be reached and in which state the
+// circuit breaker around the requests is. All devices are services of thing 1 and reached through
+// the Datamanager, so they share its status and are listed in the report with their serial.
+func (fc *FromFimpRouter) SendConnectivityReport(health Health, breaker BreakerStats) {
+	status := ConnectivityUp
+	if !health.Connected {
+		status = ConnectivityDown
+	}
+	val := map[string]string{
+		"address":              "1",
+		"status":               status,
+		"consecutive_failures": strconv.Itoa(health.ConsecutiveFailures),
+		"last_error":           health.LastError,
+		"breaker_state":        string(breaker.State),
+		"breaker_opened":       strconv.Itoa(breaker.Opened),
+	}
+	if !health.LastSuccess.IsZero() {
+		val["last_success"] = health.LastSuccess.Format(time.RFC3339)
+	}
+	var devices []string
+	for _, dev := range fc.state.KnownDevices() {
+		devices = append(devices, dev.Type+":"+dev.ID+"="+dev.Serial)
+	}
+	val["devices"] = strings.Join(devices, ",")
+	log.Info("<fimp> Inverter connectivity ", status)
+	msg := fimpgo.NewStrMapMessage("evt.thing.connectivity_report", model.ServiceName, val, nil, nil, nil)
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+	fc.publish(&adr, msg)
+	fc.SendHomeAssistantAvailability(health.Connected)
+}
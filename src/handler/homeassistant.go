@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/model"
+)
+
+// Home Assistant devices, each has its own state topic
+const (
+	haInverter = "inverter"
+	haMeter    = "meter"
+	haBattery  = "battery"
+)
+
+// haEntity describes a sensor of a Home Assistant device, key is the field in the state topic.
+type haEntity struct {
+	key         string
+	name        string
+	deviceClass string
+	stateClass  string
+	unit        string
+}
+
+var haEntities = map[string][]haEntity{
+	haInverter: {
+		{"power", "Power", "power", "measurement", "W"},
+		{"energy", "Energy", "energy", "total_increasing", "kWh"},
+		{"energy_today", "Energy today", "energy", "total_increasing", "kWh"},
+		{"ac_voltage", "AC voltage", "voltage", "measurement", "V"},
+		{"ac_current", "AC current", "current", "measurement", "A"},
+		{"frequency", "Frequency", "frequency", "measurement", "Hz"},
+		{"dc_voltage", "DC voltage", "voltage", "measurement", "V"},
+		{"dc_current", "DC current", "current", "measurement", "A"},
+	},
+	haMeter: {
+		{"power", "Grid power", "power", "measurement", "W"},
+		{"import_power", "Grid import", "power", "measurement", "W"},
+		{"export_power", "Grid export", "power", "measurement", "W"},
+		{"load_power", "Load", "power", "measurement", "W"},
+	},
+	haBattery: {
+		{"soc", "State of charge", "battery", "measurement", "%"},
+		{"power", "Power", "power", "measurement", "W"},
+		{"charge_power", "Charge power", "power", "measurement", "W"},
+		{"discharge_power", "Discharge power", "power", "measurement", "W"},
+	},
+}
+
+var haDeviceNames = map[string]string{haInverter: "Fronius inverter", haMeter: "Fronius meter", haBattery: "Fronius battery"}
+
+// haDeviceTypes maps Home Assistant devices to the Fronius device they describe.
+var haDeviceTypes = map[string]string{haInverter: model.DeviceTypeInverter, haMeter: model.DeviceTypeMeter, haBattery: model.DeviceTypeStorage}
+
+// homeAssistant remembers which entities were announced, an entity is announced once when it
+// first has a value and stays announced.
+type homeAssistant struct {
+	mux        sync.Mutex
+	discovered map[string]bool
+}
+
+func newHomeAssistant() *homeAssistant {
+	return &homeAssistant{discovered: make(map[string]bool)}
+}
+
+func (ha *homeAssistant) reset() {
+	ha.mux.Lock()
+	ha.discovered = make(map[string]bool)
+	ha.mux.Unlock()
+}
+
+// undiscovered returns the entities of device with a value in state that weren't announced yet.
+func (ha *homeAssistant) undiscovered(device string, state map[string]float64) []haEntity {
+	ha.mux.Lock()
+	defer ha.mux.Unlock()
+	var entities []haEntity
+	for _, entity := range haEntities[device] {
+		id := device + "/" + entity.key
+		if _, ok := state[entity.key]; ok && !ha.discovered[id] {
+			ha.discovered[id] = true
+			entities = append(entities, entity)
+		}
+	}
+	return entities
+}
+
+// haStates builds the state of the Home Assistant devices of the site, a device without values is left out.
+func haStates(meas *model.Measurements, counter model.EnergyCounter, inverterType string) map[string]map[string]float64 {
+	states := make(map[string]map[string]float64)
+	inverter := map[string]float64{"energy_today": meas.Site.EnergyDay / 1000}
+	if inverterType == model.InverterTypeHybrid {
+		inverter["power"] = hybridInverterReport(meas, counter)["p_export"]
+	} else {
+		inverter["power"] = meas.Site.PowerPV
+	}
+	if counter.IsValid() {
+		inverter["energy"] = counter.Total / 1000
+	}
+	// AC and DC values are only known for a single inverter read over the Solar API
+	if inverters := meas.DevicesOfType(model.DeviceTypeInverter); len(inverters) == 1 && inverters[0].VoltageAC > 0 {
+		inv := inverters[0]
+		inverter["ac_voltage"], inverter["ac_current"], inverter["frequency"] = inv.VoltageAC, inv.CurrentAC, inv.Frequency
+		inverter["dc_voltage"], inverter["dc_current"] = inv.VoltageDC, inv.CurrentDC
+	}
+	states[haInverter] = inverter
+
+	if meas.Site.HasGrid {
+		grid := gridReport(meas)
+		meter := map[string]float64{"power": meas.Site.PowerGrid, "import_power": grid["p_import"], "export_power": grid["p_export"]}
+		if meas.Site.HasLoad {
+			meter["load_power"] = math.Abs(meas.Site.PowerLoad)
+		}
+		states[haMeter] = meter
+	}
+	if meas.Site.HasBattery {
+		charge := batteryChargeReport(meas)
+		battery := map[string]float64{"power": meas.Site.PowerBattery, "charge_power": charge["p_import"], "discharge_power": charge["p_export"]}
+		if soc := batteryLevel(meas); soc > 0 {
+			battery["soc"] = float64(soc)
+		}
+		states[haBattery] = battery
+	}
+	return states
+}
+
+// SendHomeAssistantState publishes the measurements on the Home Assistant state topics, and
+// the discovery configs of entities that weren't announced yet. Both are retained, so Home
+// Assistant gets them after a restart.
+func (fc *FromFimpRouter) SendHomeAssistantState(meas *model.Measurements) {
+	if !fc.configs.HomeAssistantEnabled {
+		return
+	}
+	counter := fc.state.EnergyCounter(model.CounterPV)
+	for device, state := range haStates(meas, counter, fc.configs.Type) {
+		for _, entity := range fc.homeAssistant.undiscovered(device, state) {
+			fc.publishRetained(fc.haConfigTopic(device, entity), "homeassistant.config", fc.haConfig(device, entity))
+		}
+		fc.publishRetained(fc.configs.HomeAssistantStateTopic(device), "homeassistant.state", state)
+	}
+}
+
+// SendHomeAssistantAvailability marks all entities available or unavailable.
+func (fc *FromFimpRouter) SendHomeAssistantAvailability(online bool) {
+	if !fc.configs.HomeAssistantEnabled {
+		return
+	}
+	status := "offline"
+	if online {
+		status = "online"
+	}
+	token := fc.mqt.Client().Publish(fc.configs.HomeAssistantStateTopic("availability"), 1, true, status)
+	if !token.WaitTimeout(5 * time.Second) {
+		log.Warn("<fimp> Home Assistant availability not confirmed by the broker")
+	}
+	fc.countPublished("homeassistant.availability")
+}
+
+func (fc *FromFimpRouter) haConfigTopic(device string, entity haEntity) string {
+	return fc.configs.HomeAssistantDiscoveryPrefix() + "/sensor/" + fc.haDeviceID(device) + "/" + entity.key + "/config"
+}
+
+func (fc *FromFimpRouter) haDeviceID(device string) string {
+	instance := fc.configs.InstanceAddress
+	if instance == "" {
+		instance = "1"
+	}
+	return model.ServiceName + "_" + instance + "_" + device
+}
+
+// haConfig builds the discovery config of an entity. The device gets model and serial number
+// from the device list of the Datamanager, if it was read.
+func (fc *FromFimpRouter) haConfig(device string, entity haEntity) map[string]interface{} {
+	haDevice := map[string]interface{}{
+		"identifiers":  []string{fc.haDeviceID(device)},
+		"name":         haDeviceNames[device],
+		"manufacturer": "Fronius",
+	}
+	for _, identity := range fc.state.KnownDevices() {
+		if identity.Type == haDeviceTypes[device] {
+			if identity.Name != "" {
+				haDevice["model"] = identity.Name
+			}
+			if identity.Serial != "" {
+				haDevice["serial_number"] = identity.Serial
+			}
+			break
+		}
+	}
+	return map[string]interface{}{
+		"name":                entity.name,
+		"unique_id":           fc.haDeviceID(device) + "_" + entity.key,
+		"state_topic":         fc.configs.HomeAssistantStateTopic(device),
+		"value_template":      "{{ value_json." + entity.key + " }}",
+		"device_class":        entity.deviceClass,
+		"state_class":         entity.stateClass,
+		"unit_of_measurement": entity.unit,
+		"availability_topic":  fc.configs.HomeAssistantStateTopic("availability"),
+		"device":              haDevice,
+	}
+}
+
+// publishRetained publishes a JSON payload outside of FIMP, counted as msgType.
+func (fc *FromFimpRouter) publishRetained(topic string, msgType string, val interface{}) {
+	payload, err := json.Marshal(val)
+	if err != nil {
+		log.Error("<fimp> Can't serialize ", msgType, ". Error: ", err)
+		return
+	}
+	fc.mqt.Client().Publish(topic, 1, true, payload)
+	fc.countPublished(msgType)
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/model"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// newInverterHTTPClient returns the client used for Solar API requests. In replay mode it answers
+// from a capture file, with capture enabled it records every response to the data dir. Polls set
+// their own deadline, the client timeout only guards against a hanging Datamanager.
+func newInverterHTTPClient(configs *model.Configs) *http.Client {
+	if configs.IsReplay() {
+		replay, err := fronius.LoadReplayTransport(configs.GetReplayFile())
+		if err == nil {
+			log.Info("<poller> Replaying responses from ", configs.GetReplayFile())
+			return &http.Client{Transport: replay}
+		}
+		log.Error("<poller> Can't load replay file. Error: ", err)
+	}
+	if configs.CaptureEnabled {
+		log.Info("<poller> Capturing responses to ", configs.GetCaptureFile())
+		out := &lumberjack.Logger{
+			Filename:   configs.GetCaptureFile(),
+			MaxSize:    5, // megabytes
+			MaxBackups: 3,
+		}
+		return &http.Client{Transport: fronius.NewCaptureTransport(http.DefaultTransport, out), Timeout: configs.RequestTimeout()}
+	}
+	return &http.Client{Timeout: configs.RequestTimeout()}
+}
+
+// httpClientSettings are the configs the inverter HTTP client is built from.
+type httpClientSettings struct {
+	timeout time.Duration
+	capture bool
+	replay  string
+}
+
+func clientSettings(configs *model.Configs) httpClientSettings {
+	return httpClientSettings{timeout: configs.RequestTimeout(), capture: configs.CaptureEnabled, replay: configs.GetReplayFile()}
+}
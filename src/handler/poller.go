@@ -0,0 +1,498 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/datasource"
+	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/model"
+	"github.com/thingsplex/fronius/utils"
+)
+
+// Poller periodically reads the configured data source and publishes the measurements.
+// Power values are read every poll, energy counters and the device list at their own slower rates.
+// While the inverters sleep it polls at the slower night rate and publishes zero production once.
+// Configs must only be changed while the poller is stopped.
+type Poller struct {
+	configs         *model.Configs
+	states          *model.State
+	router          *FromFimpRouter
+	appLifecycle    *edgeapp.Lifecycle
+	httpClient      *http.Client
+	health          *healthMonitor
+	breaker         *circuitBreaker
+	pollNowCh       chan chan struct{}
+	mux             sync.Mutex
+	stopCh          chan struct{}
+	doneCh          chan struct{}
+	interval        time.Duration
+	stats           PollStats
+	sinks           []MeasurementSink
+	sleeping        bool
+	includedDevices string
+	energyUpdatedAt time.Time
+	devicesReadAt   time.Time
+	minMaxReadAt    time.Time
+	inverterData    map[string]model.InverterData
+	inverterReadAt  time.Time
+}
+
+// MeasurementSink receives the measurements the poller publishes, e.g. to export them, and those
+// of a meter that is read while the inverters sleep. Add is called from the poll loop and must
+// not block.
+type MeasurementSink interface {
+	Add(measurements *model.Measurements)
+}
+
+// PollStats count the polls since the adapter started, including failed ones and probes.
+type PollStats struct {
+	Polls         int           `json:"polls"`
+	LastDuration  time.Duration `json:"last_duration"`
+	TotalDuration time.Duration `json:"total_duration"`
+}
+
+func NewPoller(configs *model.Configs, states *model.State, router *FromFimpRouter, appLifecycle *edgeapp.Lifecycle) *Poller {
+	return &Poller{configs: configs, states: states, router: router, appLifecycle: appLifecycle,
+		httpClient: newInverterHTTPClient(configs), health: newHealthMonitor(appLifecycle), breaker: newCircuitBreaker(), pollNowCh: make(chan chan struct{})}
+}
+
+// AddSink adds a receiver of the measurements, it must be called before Start.
+func (p *Poller) AddSink(sink MeasurementSink) {
+	p.sinks = append(p.sinks, sink)
+}
+
+// Start starts polling in the background. Energy counters and the device list are read when due
+// according to the persisted schedule, right away on a new site.
+func (p *Poller) Start() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.stopCh != nil {
+		return
+	}
+	p.stopCh = make(chan struct{})
+	p.doneCh = make(chan struct{})
+	p.sleeping = false
+	schedule := p.states.GetSchedule()
+	p.energyUpdatedAt, p.devicesReadAt, p.minMaxReadAt = schedule.EnergyUpdatedAt, schedule.DevicesReadAt, schedule.MinMaxReadAt
+	p.inverterData, p.inverterReadAt = nil, time.Time{}
+	p.health.reset(p.states.GetLastSuccess())
+	go p.run(p.stopCh, p.doneCh)
+	log.Info("<poller> Started")
+}
+
+// Stop cancels a poll in progress and blocks until the poller has stopped. It returns false if
+// the poller wasn't running.
+func (p *Poller) Stop() bool {
+	p.mux.Lock()
+	stopCh, doneCh := p.stopCh, p.doneCh
+	p.stopCh, p.doneCh = nil, nil
+	p.mux.Unlock()
+	if stopCh == nil {
+		return false
+	}
+	close(stopCh)
+	<-doneCh
+	log.Info("<poller> Stopped")
+	return true
+}
+
+// run polls until stopCh is closed, the interval is chosen again after every poll.
+func (p *Poller) run(stopCh chan struct{}, doneCh chan struct{}) {
+	defer close(doneCh)
+	defer p.states.SaveToFile()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		var done chan struct{}
+		select {
+		case <-stopCh:
+			return
+		case <-timer.C:
+		case done = <-p.pollNowCh:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		started := time.Now()
+		interval := p.poll(ctx)
+		duration := time.Since(started)
+		p.mux.Lock()
+		p.interval = interval
+		p.stats.Polls++
+		p.stats.LastDuration = duration
+		p.stats.TotalDuration += duration
+		p.mux.Unlock()
+		if done != nil {
+			close(done)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// PollNow polls immediately instead of waiting for the next interval. It returns false if the
+// poll didn't complete within timeout.
+func (p *Poller) PollNow(timeout time.Duration) bool {
+	done := make(chan struct{})
+	select {
+	case p.pollNowCh <- done:
+	case <-time.After(timeout):
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// setHTTPClient replaces the client used for requests to the inverter, the poller must be stopped.
+func (p *Poller) setHTTPClient(client *http.Client) {
+	p.httpClient = client
+}
+
+// Health returns the state of the connection to the inverter.
+func (p *Poller) Health() Health {
+	return p.health.status()
+}
+
+// Breaker returns the state and counters of the circuit breaker around inverter requests.
+func (p *Poller) Breaker() BreakerStats {
+	return p.breaker.statsSnapshot()
+}
+
+// Stats returns how many polls were made and how long they took.
+func (p *Poller) Stats() PollStats {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.stats
+}
+
+// IsStale returns true if the measurements are older than two poll intervals.
+func (p *Poller) IsStale(measurements *model.Measurements) bool {
+	if measurements == nil {
+		return true
+	}
+	p.mux.Lock()
+	interval := p.interval
+	p.mux.Unlock()
+	return time.Since(measurements.Timestamp) > 2*interval
+}
+
+func (p *Poller) poll(ctx context.Context) time.Duration {
+	defer p.saveState()
+	if p.configs.Host == "host_ip" && !p.configs.IsReplay() {
+		log.Debug("-------NOT CONNECTED------")
+		return p.pollInterval()
+	}
+	client := fronius.NewClient(p.configs.Host, p.httpClient)
+	src, err := datasource.New(p.configs.Type, client)
+	if err != nil {
+		log.Debug("<poller> ", err)
+		return p.pollInterval()
+	}
+	if p.breaker.isOpen() {
+		p.breaker.probed(p.probe(ctx, client))
+		if p.breaker.isOpen() {
+			return p.retryInterval()
+		}
+	}
+	if lister, ok := src.(datasource.DeviceLister); ok && p.devicesDue() {
+		p.readDevices(ctx, lister)
+	}
+	if reader, ok := src.(datasource.InverterDataReader); ok && !p.sleeping && p.inverterDataDue() {
+		p.readInverterData(ctx, reader)
+	}
+	if reader, ok := src.(datasource.MinMaxReader); ok && !p.sleeping && p.minMaxDue() {
+		p.readMinMax(ctx, reader)
+	}
+	if reader, ok := src.(datasource.MeterReader); ok {
+		reader.SetMeter(hasMeter(p.states.KnownDevices()))
+	}
+	fetchCtx, cancel := context.WithTimeout(ctx, p.configs.RequestTimeout())
+	measurements, err := src.Fetch(fetchCtx)
+	cancel()
+	if ctx.Err() != nil {
+		return p.pollInterval()
+	}
+	if err != nil {
+		if !p.sleeping && !p.isNight() {
+			p.breaker.failure(fmt.Errorf("%s: %w", src.Name(), err), p.configs.OfflineAfter())
+			if p.health.failure(err, p.configs.OfflineAfter()) {
+				p.router.SendConnectivityReport(p.health.status(), p.breaker.statsSnapshot())
+			}
+			return p.retryInterval()
+		}
+		log.Debug("<poller> Inverter not reachable, assuming it sleeps - ", err)
+		measurements = p.lastMeasurements(src.Name()).Asleep()
+	} else {
+		p.breaker.success()
+		p.states.SetLastSuccess(measurements.Timestamp)
+		if p.health.success(measurements.Timestamp) {
+			p.router.SendConnectivityReport(p.health.status(), p.breaker.statsSnapshot())
+		}
+		if measurements.Sleeping && measurements.Site.EnergyTotal == 0 {
+			measurements = p.lastMeasurements(src.Name()).Asleep().WithMeter(measurements)
+		} else if !measurements.Sleeping {
+			measurements.SetInverterData(p.inverterData)
+		}
+	}
+	if measurements.Site.HasLoad {
+		p.states.IntegrateEnergyCounter(model.CounterLoad, math.Abs(measurements.Site.PowerLoad), measurements.Timestamp)
+	}
+
+	if measurements.Sleeping {
+		return p.sleep(measurements)
+	}
+	if p.sleeping {
+		log.Info("<poller> Inverter woke up, resuming normal polling")
+		p.sleeping = false
+	}
+	p.publish(measurements)
+	return p.pollInterval()
+}
+
+// sleep publishes zero production once when the inverters go to sleep and returns the interval to
+// poll at while they sleep.
+func (p *Poller) sleep(measurements *model.Measurements) time.Duration {
+	if !p.sleeping {
+		log.Infof("<poller> Inverter is asleep, polling every %s until it wakes up", p.configs.NightPollTime())
+		p.sleeping = true
+		p.publish(measurements)
+		// the day's production is over
+		p.sendDailySummaries(time.Now().AddDate(0, 0, 1).Format(model.DateLayout))
+	} else if measurements.Site.HasGrid || measurements.Site.HasLoad {
+		// the meter keeps measuring the grid and the house consumption
+		p.states.SetMeasurements(measurements)
+		p.addToSinks(measurements)
+		p.router.sendHouseLoadReport(measurements)
+	}
+	// the sun is up, so the inverter will wake up soon and is polled at normal rate again
+	if p.configs.HasLocation() && !p.isNight() {
+		return p.pollInterval()
+	}
+	return p.configs.NightPollTime()
+}
+
+func (p *Poller) publish(measurements *model.Measurements) {
+	devices := deviceSet(measurements)
+	// the inclusion report is built from the latest measurements
+	p.states.SetMeasurements(measurements)
+	if p.appLifecycle.ConfigState() == edgeapp.ConfigStateNotConfigured {
+		p.router.SendInclusionReport()
+		p.appLifecycle.SetConfigState(edgeapp.ConfigStateConfigured)
+		p.includedDevices = devices
+	} else if devices != p.includedDevices {
+		log.Info("<poller> Devices changed from [", p.includedDevices, "] to [", devices, "], sending new inclusion report")
+		p.router.SendInclusionReport()
+		p.includedDevices = devices
+	}
+	p.addToSinks(measurements)
+	if !measurements.Sleeping {
+		p.states.UpdateMinMaxEnergy(measurements)
+	}
+	if time.Since(p.energyUpdatedAt) >= p.configs.EnergyPollTime() {
+		_, err := p.states.UpdateEnergyCounter(model.CounterPV, measurements.Site.EnergyTotal, measurements.Timestamp, p.configs.MaxSitePower())
+		if err != nil {
+			log.Warn("<poller> ", err)
+		}
+		p.energyUpdatedAt = measurements.Timestamp
+	}
+	if p.configs.Type == model.InverterTypeHybrid {
+		p.router.SendHybridMeasurements(measurements)
+	} else {
+		p.router.SendMeasurements(measurements)
+	}
+}
+
+// addToSinks passes measurements to the sinks, the published ones and those of a meter that is
+// read while the inverters sleep.
+func (p *Poller) addToSinks(measurements *model.Measurements) {
+	for _, sink := range p.sinks {
+		sink.Add(measurements)
+	}
+}
+
+// deviceSet identifies the devices of a site and their DC inputs, so changes can be detected.
+func deviceSet(measurements *model.Measurements) string {
+	var devices []string
+	for _, dev := range measurements.Devices {
+		devices = append(devices, dev.Type+":"+dev.ID)
+		for _, input := range dev.DCInputs {
+			devices = append(devices, fmt.Sprintf("%s:%s/dc%d", dev.Type, dev.ID, input.Index))
+		}
+	}
+	sort.Strings(devices)
+	return strings.Join(devices, ",")
+}
+
+func (p *Poller) saveState() {
+	p.states.SetSchedule(model.Schedule{EnergyUpdatedAt: p.energyUpdatedAt, DevicesReadAt: p.devicesReadAt, MinMaxReadAt: p.minMaxReadAt})
+	if err := p.states.SaveCoalesced(p.configs.StateSaveInterval()); err != nil {
+		log.Error("<poller> Can't save state. Error: ", err)
+	}
+}
+
+func (p *Poller) devicesDue() bool {
+	return time.Since(p.devicesReadAt) >= p.configs.DeviceInfoPollTime()
+}
+
+// readDevices refreshes the device list. A failure is retried after the energy poll interval,
+// not with every poll.
+func (p *Poller) readDevices(ctx context.Context, lister datasource.DeviceLister) {
+	ctx, cancel := context.WithTimeout(ctx, p.configs.RequestTimeout())
+	defer cancel()
+	devices, err := lister.ListDevices(ctx)
+	if err != nil {
+		log.Debug("<poller> Can't read device info - ", err)
+		p.devicesReadAt = time.Now().Add(p.configs.EnergyPollTime() - p.configs.DeviceInfoPollTime())
+		return
+	}
+	p.devicesReadAt = time.Now()
+	if known := p.states.KnownDevices(); !reflect.DeepEqual(known, devices) {
+		log.Infof("<poller> Site devices: %+v", devices)
+		// announced again with model and serial number
+		p.router.homeAssistant.reset()
+		if hasMeter(known) != hasMeter(devices) {
+			// the self-consumption service is only included with a meter
+			p.includedDevices = ""
+		}
+	}
+	p.states.SetDevices(devices)
+}
+
+func (p *Poller) inverterDataDue() bool {
+	return time.Since(p.inverterReadAt) >= p.configs.EnergyPollTime()
+}
+
+// readInverterData reads the DC inputs and the AC voltage and frequency of the inverters with one
+// request per inverter, they are published with the measurements until the next read.
+func (p *Poller) readInverterData(ctx context.Context, reader datasource.InverterDataReader) {
+	ctx, cancel := context.WithTimeout(ctx, p.configs.RequestTimeout())
+	defer cancel()
+	p.inverterReadAt = time.Now()
+	data, err := reader.ReadInverterData(ctx, p.inverterIDs())
+	if err != nil {
+		log.Debug("<poller> Can't read inverter data - ", err)
+		return
+	}
+	p.inverterData = data
+}
+
+func (p *Poller) minMaxDue() bool {
+	return time.Since(p.minMaxReadAt) >= p.configs.MinMaxPollTime()
+}
+
+// readMinMax reads the min/max values of the inverters and keeps them in the state, along with
+// the production of the day. Values of an earlier day are summarised before they are replaced.
+func (p *Poller) readMinMax(ctx context.Context, reader datasource.MinMaxReader) {
+	ctx, cancel := context.WithTimeout(ctx, p.configs.RequestTimeout())
+	defer cancel()
+	p.minMaxReadAt = time.Now()
+	values, err := reader.ReadMinMax(ctx, p.inverterIDs())
+	if err != nil {
+		log.Debug("<poller> Can't read min/max values - ", err)
+		return
+	}
+	p.sendDailySummaries(time.Now().Format(model.DateLayout))
+	last := p.states.LatestMeasurements()
+	for id, minMax := range values {
+		if last != nil {
+			if inv := last.Device(model.DeviceTypeInverter, id); inv != nil {
+				minMax.EnergyDay = inv.EnergyDay
+			}
+		}
+		p.states.SetMinMax(id, minMax)
+	}
+}
+
+// sendDailySummaries publishes the summaries of the days before the given date that weren't
+// published yet.
+func (p *Poller) sendDailySummaries(before string) {
+	for _, date := range p.states.MinMaxDates() {
+		if date >= before || date <= p.states.GetLastSummary() {
+			continue
+		}
+		if summary, ok := p.states.DailySummary(date); ok {
+			log.Infof("<poller> Daily summary of %s, peak power %.0f W", date, summary.Site.PowerMax)
+			p.router.SendDailySummary(summary)
+		}
+		p.states.SetLastSummary(date)
+	}
+}
+
+// inverterIDs returns the ids of the listed inverters, without any the only one has id 1.
+func (p *Poller) inverterIDs() []string {
+	var inverters []string
+	for _, dev := range p.states.KnownDevices() {
+		if dev.Type == model.DeviceTypeInverter {
+			inverters = append(inverters, dev.ID)
+		}
+	}
+	if len(inverters) == 0 {
+		inverters = []string{"1"}
+	}
+	return inverters
+}
+
+func hasMeter(devices []model.DeviceIdentity) bool {
+	for _, dev := range devices {
+		if dev.Type == model.DeviceTypeMeter {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Poller) lastMeasurements(source string) *model.Measurements {
+	if last := p.states.LatestMeasurements(); last != nil {
+		return last
+	}
+	return model.NewMeasurements(source)
+}
+
+// isNight uses the configured site coordinates as a hint, without them it's never night.
+func (p *Poller) isNight() bool {
+	if !p.configs.HasLocation() {
+		return false
+	}
+	return !utils.IsSunUp(time.Now(), p.configs.Latitude, p.configs.Longitude)
+}
+
+// probe checks with the cheapest request if the Datamanager answers again. Replayed captures
+// don't need to contain it.
+func (p *Poller) probe(ctx context.Context, client *fronius.Client) error {
+	if p.configs.IsReplay() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.configs.RequestTimeout())
+	defer cancel()
+	_, err := client.GetAPIVersion(ctx)
+	return err
+}
+
+// retryInterval is the poll interval after a failure, growing with every failure in a row.
+func (p *Poller) retryInterval() time.Duration {
+	return p.breaker.backoff(p.pollInterval(), p.configs.MaxBackoff())
+}
+
+func (p *Poller) pollInterval() time.Duration {
+	return p.configs.PowerPollTime()
+}
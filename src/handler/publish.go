@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"github.com/futurehomeno/fimpgo"
+)
+
+// publish sends msg to adr and counts it by message type.
+func (fc *FromFimpRouter) publish(adr *fimpgo.Address, msg *fimpgo.FimpMessage) error {
+	err := fc.mqt.Publish(adr, msg)
+	if err == nil {
+		fc.countPublished(msg.Type)
+	}
+	return err
+}
+
+// respond sends msg to the response topic of request and counts it by message type.
+func (fc *FromFimpRouter) respond(request *fimpgo.FimpMessage, msg *fimpgo.FimpMessage) error {
+	err := fc.mqt.RespondToRequest(request, msg)
+	if err == nil {
+		fc.countPublished(msg.Type)
+	}
+	return err
+}
+
+func (fc *FromFimpRouter) countPublished(msgType string) {
+	fc.publishedMux.Lock()
+	fc.published[msgType]++
+	fc.publishedMux.Unlock()
+}
+
+// PublishCounts returns how many messages were published to the broker, by message type.
+func (fc *FromFimpRouter) PublishCounts() map[string]uint64 {
+	fc.publishedMux.Lock()
+	defer fc.publishedMux.Unlock()
+	counts := make(map[string]uint64, len(fc.published))
+	for msgType, n := range fc.published {
+		counts[msgType] = n
+	}
+	return counts
+}
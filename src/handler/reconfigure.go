@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"github.com/futurehomeno/fimpgo"
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/model"
+)
+
+// withPollerStopped runs change while the poller is stopped, so it never sees a half applied config.
+// A poller that was running is started again afterwards. The configs are locked while change runs.
+// The HTTP client is built again if change touched its settings.
+func (fc *FromFimpRouter) withPollerStopped(change func()) {
+	if fc.poller != nil && fc.poller.Stop() {
+		defer fc.poller.Start()
+	}
+	fc.configMux.Lock()
+	defer fc.configMux.Unlock()
+	settings := clientSettings(fc.configs)
+	change()
+	if fc.poller != nil && clientSettings(fc.configs) != settings {
+		fc.poller.setHTTPClient(newInverterHTTPClient(fc.configs))
+	}
+}
+
+// ConfigSnapshot returns a copy of the configs that is consistent with concurrent changes.
+func (fc *FromFimpRouter) ConfigSnapshot() model.Configs {
+	fc.configMux.RLock()
+	defer fc.configMux.RUnlock()
+	return *fc.configs
+}
+
+// redactedConfigs returns a snapshot of the configs without credentials, for reports to the hub.
+func (fc *FromFimpRouter) redactedConfigs() model.Configs {
+	conf := fc.ConfigSnapshot()
+	return conf.Redacted()
+}
+
+// applyConfig validates and applies the inverter settings, poll intervals and request timeout of conf. When the
+// inverter type changes the device is excluded, the poller includes it again with the services of the new type.
+// Capture and replay are development settings that are only read from config.json.
+func (fc *FromFimpRouter) applyConfig(conf model.Configs) error {
+	if err := conf.ValidateInverter(); err != nil {
+		return err
+	}
+	fc.withPollerStopped(func() {
+		typeChanged := conf.Type != fc.configs.Type
+		hostChanged := conf.Host != fc.configs.Host
+		fc.configs.Host = conf.Host
+		fc.configs.Type = conf.Type
+		fc.configs.Value1 = conf.Value1
+		fc.configs.Value2 = conf.Value2
+		// poll intervals are optional in the request, zero keeps the current setting
+		if conf.PollTimeSec > 0 {
+			fc.configs.PollTimeSec = conf.PollTimeSec
+		}
+		if conf.EnergyPollTimeSec > 0 {
+			fc.configs.EnergyPollTimeSec = conf.EnergyPollTimeSec
+		}
+		if conf.DeviceInfoPollTimeSec > 0 {
+			fc.configs.DeviceInfoPollTimeSec = conf.DeviceInfoPollTimeSec
+		}
+		if conf.MinMaxPollTimeSec > 0 {
+			fc.configs.MinMaxPollTimeSec = conf.MinMaxPollTimeSec
+		}
+		if conf.RequestTimeoutSec > 0 {
+			fc.configs.RequestTimeoutSec = conf.RequestTimeoutSec
+		}
+		if err := fc.configs.SaveToFile(); err != nil {
+			log.Error("<fimp> Can't save configs. Error: ", err)
+		}
+		if typeChanged {
+			log.Info("<fimp> Inverter type changed to ", conf.Type, ", devices will be included again")
+			fc.excludeDevices()
+			fc.state.ResetSite()
+			fc.homeAssistant.reset()
+		} else if hostChanged {
+			// the counters of the new host don't continue the old ones, energy and devices
+			// are read from it right away
+			log.Info("<fimp> Inverter host changed, energy counters start over")
+			fc.state.ResetCounters()
+		}
+		fc.reportFilter.reset()
+	})
+	fc.UpdateAppState()
+	return nil
+}
+
+// excludeDevices sends an exclusion report for included devices and marks the app as not
+// configured, so the next successful poll includes them again.
+func (fc *FromFimpRouter) excludeDevices() {
+	if fc.appLifecycle.ConfigState() == edgeapp.ConfigStateConfigured {
+		exclReport := map[string]string{"address": "1"}
+		msg := fimpgo.NewMessage("evt.thing.exclusion_report", "fronius", fimpgo.VTypeObject, exclReport, nil, nil, nil)
+		adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "fronius", ResourceAddress: "1"}
+		fc.publish(&adr, msg)
+	}
+	fc.appLifecycle.SetConfigState(edgeapp.ConfigStateNotConfigured)
+}
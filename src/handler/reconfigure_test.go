@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	"github.com/thingsplex/fronius/model"
+)
+
+func TestReconfigureHTTPClient(t *testing.T) {
+	configs := &model.Configs{}
+	poller := NewPoller(configs, &model.State{}, nil, edgeapp.NewAppLifecycle())
+	fc := &FromFimpRouter{configs: configs, poller: poller}
+
+	client := poller.httpClient
+	fc.withPollerStopped(func() { configs.PollTimeSec = 10 })
+	if poller.httpClient != client {
+		t.Error("client built again without a change of its settings")
+	}
+	fc.withPollerStopped(func() { configs.RequestTimeoutSec = 3 })
+	if poller.httpClient == client || poller.httpClient.Timeout != 3*time.Second {
+		t.Errorf("request timeout not applied, client timeout %v", poller.httpClient.Timeout)
+	}
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thingsplex/fronius/model"
+)
+
+// reportFilter remembers the last published value map per topic and holds back reports
+// that don't move any value outside of its deadband until the heartbeat expires.
+type reportFilter struct {
+	mux  sync.Mutex
+	last map[string]publishedReport
+}
+
+// deltaValues are accumulated since the previous report and restart from zero with every report,
+// so they are never compared against deadbands. They are published along with the other values.
+var deltaValues = map[string]bool{
+	"last_e_export": true,
+	"last_e_import": true,
+}
+
+type publishedReport struct {
+	values map[string]float64
+	sentAt time.Time
+}
+
+func newReportFilter() *reportFilter {
+	return &reportFilter{last: make(map[string]publishedReport)}
+}
+
+// shouldPublish decides if val has to be published on topic and records it as sent if so.
+func (rf *reportFilter) shouldPublish(topic string, val map[string]float64, configs *model.Configs) bool {
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+	last, ok := rf.last[topic]
+	publish := !ok || rf.heartbeatExpired(last, configs) || rf.changed(last, val, configs)
+	if publish {
+		values := make(map[string]float64, len(val))
+		for k, v := range val {
+			values[k] = v
+		}
+		rf.last[topic] = publishedReport{values: values, sentAt: time.Now()}
+	}
+	return publish
+}
+
+// reset forgets everything sent so far, the next report on every topic is published.
+func (rf *reportFilter) reset() {
+	rf.mux.Lock()
+	rf.last = make(map[string]publishedReport)
+	rf.mux.Unlock()
+}
+
+func (rf *reportFilter) heartbeatExpired(last publishedReport, configs *model.Configs) bool {
+	return time.Since(last.sentAt) >= configs.ReportHeartbeat()
+}
+
+func (rf *reportFilter) changed(last publishedReport, val map[string]float64, configs *model.Configs) bool {
+	if len(val) != len(last.values) {
+		return true
+	}
+	for name, current := range val {
+		if deltaValues[name] {
+			continue
+		}
+		previous, ok := last.values[name]
+		if !ok || configs.DeadbandFor(name).Exceeded(previous, current) {
+			return true
+		}
+	}
+	return false
+}
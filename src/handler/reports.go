@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/model"
+)
+
+const getReportPollTimeout = 15 * time.Second
+
+// respondWithReport answers a get_report command from the cached measurements. If the cache
+// is stale the answer waits for an immediate poll, which runs outside of the router, so other
+// messages are handled meanwhile. Requests arriving during that poll are answered with it.
+func (fc *FromFimpRouter) respondWithReport(newMsg *fimpgo.Message) {
+	meas := fc.state.LatestMeasurements()
+	if fc.poller == nil || !fc.poller.IsStale(meas) {
+		fc.sendReport(newMsg, meas)
+		return
+	}
+	fc.pendingMux.Lock()
+	defer fc.pendingMux.Unlock()
+	fc.pendingReports = append(fc.pendingReports, newMsg)
+	if len(fc.pendingReports) == 1 {
+		log.Debug("<fimp> Cached measurements are stale, polling before responding")
+		go fc.pollAndRespond()
+	}
+}
+
+// pollAndRespond polls and answers all get_report commands that were waiting for the poll.
+func (fc *FromFimpRouter) pollAndRespond() {
+	if !fc.poller.PollNow(getReportPollTimeout) {
+		log.Warn("<fimp> Poll triggered by get_report timed out")
+	}
+	fc.pendingMux.Lock()
+	pending := fc.pendingReports
+	fc.pendingReports = nil
+	fc.pendingMux.Unlock()
+	meas := fc.state.LatestMeasurements()
+	for _, newMsg := range pending {
+		fc.sendReport(newMsg, meas)
+	}
+}
+
+func (fc *FromFimpRouter) sendReport(newMsg *fimpgo.Message, meas *model.Measurements) {
+	if meas == nil {
+		log.Warn("<fimp> No measurements available, can't respond to ", newMsg.Payload.Type)
+		return
+	}
+
+	service := newMsg.Addr.ServiceName
+	fc.configMux.RLock()
+	msg, err := fc.serviceReport(service, newMsg.Addr.ServiceAddress, newMsg.Payload.Type, meas, newMsg.Payload)
+	fc.configMux.RUnlock()
+	if err != nil {
+		log.Error("<fimp> ", err)
+		return
+	}
+	if err := fc.respond(newMsg.Payload, msg); err != nil {
+		adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName,
+			ResourceAddress: "1", ServiceName: service, ServiceAddress: newMsg.Addr.ServiceAddress}
+		fc.publish(&adr, msg)
+	}
+}
+
+// serviceReport builds the report a service answers the get_report command cmdType with. The
+// address tells the DC inputs of the inverter_solar_conn service apart.
+func (fc *FromFimpRouter) serviceReport(service, address, cmdType string, meas *model.Measurements, request *fimpgo.FimpMessage) (*fimpgo.FimpMessage, error) {
+	switch cmdType {
+	case "cmd.meter_ext.get_report":
+		var val map[string]float64
+		switch service {
+		case "inverter":
+			counter := fc.state.EnergyCounter(model.CounterPV)
+			if fc.configs.Type == model.InverterTypeHybrid {
+				val = withoutDelta(hybridInverterReport(meas, counter))
+			} else {
+				val = withoutDelta(inverterReport(meas, counter))
+			}
+		case "inverter_grid_conn":
+			val = gridReport(meas)
+		case "inverter_solar_conn":
+			if input, ok := findDCInput(meas, address); ok {
+				val = dcInputReport(input)
+			} else {
+				val = solarReport(meas)
+			}
+		case "battery_charge_ctrl":
+			val = batteryChargeReport(meas)
+		case model.HouseLoadService:
+			val = withoutDelta(houseLoadReport(meas, fc.state.EnergyCounter(model.CounterLoad)))
+		default:
+			return nil, fmt.Errorf("service %s has no meter_ext report", service)
+		}
+		return fimpgo.NewMessage("evt.meter_ext.report", service, fimpgo.VTypeFloatMap, val, nil, nil, request), nil
+
+	case "cmd.self_consumption.get_report":
+		if service != model.SelfConsumptionService {
+			return nil, fmt.Errorf("service %s has no self_consumption report", service)
+		}
+		val := selfConsumptionReport(meas, fc.dayTotals())
+		return fimpgo.NewMessage("evt.self_consumption.report", service, fimpgo.VTypeFloatMap, val, nil, nil, request), nil
+
+	case "cmd.mode.get_report":
+		if service != "battery_charge_ctrl" {
+			return nil, fmt.Errorf("service %s has no mode report", service)
+		}
+		return fimpgo.NewStringMessage("evt.mode.report", service, batteryMode(meas), nil, nil, request), nil
+
+	case "cmd.lvl.get_report":
+		if service != "battery" {
+			return nil, fmt.Errorf("service %s has no lvl report", service)
+		}
+		return fimpgo.NewIntMessage("evt.lvl.report", service, batteryLevel(meas), nil, nil, request), nil
+	}
+	return nil, fmt.Errorf("unsupported report request %s", cmdType)
+}
+
+// inverterReport reports the lifetime production as e_export and the production since the last
+// published report as last_e_export, both in kWh.
+func inverterReport(meas *model.Measurements, counter model.EnergyCounter) map[string]float64 {
+	val := make(map[string]float64)
+	val["p_export"] = meas.Site.PowerPV
+	addEnergyExport(val, counter)
+	return val
+}
+
+func hybridInverterReport(meas *model.Measurements, counter model.EnergyCounter) map[string]float64 {
+	val := make(map[string]float64)
+	val["p_export"] = 0
+	for _, inv := range meas.DevicesOfType(model.DeviceTypeInverter) {
+		val["p_export"] += inv.Power
+	}
+	addEnergyExport(val, counter)
+	return val
+}
+
+func addEnergyExport(val map[string]float64, counter model.EnergyCounter) {
+	if !counter.IsValid() {
+		return
+	}
+	val["e_export"] = counter.Total / 1000
+	val["last_e_export"] = counter.Unreported() / 1000
+}
+
+// withoutDelta leaves the energy since the previous report out of a get_report answer. Only the
+// published reports mark energy as reported, so it would be counted twice.
+func withoutDelta(val map[string]float64) map[string]float64 {
+	delete(val, "last_e_export")
+	delete(val, "last_e_import")
+	return val
+}
+
+// houseLoadReport reports the consumption of the house as import. e_import is the energy the
+// adapter counted from the load power and last_e_import the part since the previous report, in kWh.
+func houseLoadReport(meas *model.Measurements, counter model.EnergyCounter) map[string]float64 {
+	val := make(map[string]float64)
+	if meas.Site.HasLoad {
+		val["p_import"] = math.Abs(meas.Site.PowerLoad)
+	}
+	if counter.IsValid() {
+		val["e_import"] = counter.Total / 1000
+		val["last_e_import"] = counter.Unreported() / 1000
+	}
+	return val
+}
+
+// gridReport splits the grid power into import and export, Fronius reports import as positive.
+func gridReport(meas *model.Measurements) map[string]float64 {
+	val := make(map[string]float64)
+	val["p_import"] = math.Max(meas.Site.PowerGrid, 0)
+	val["p_export"] = math.Max(-meas.Site.PowerGrid, 0)
+	return val
+}
+
+func solarReport(meas *model.Measurements) map[string]float64 {
+	val := make(map[string]float64)
+	val["p_export"] = meas.Site.PowerPV
+	return val
+}
+
+// selfConsumptionReport reports the current autonomy and self-consumption, as the powerflow or
+// the meter data tell, and the ones of the current day from the statistics, all in %. Values that
+// aren't known are left out.
+func selfConsumptionReport(meas *model.Measurements, day model.EnergyTotals) map[string]float64 {
+	val := make(map[string]float64)
+	if meas.Site.HasGrid {
+		val["rel_autonomy"] = roundPercent(meas.Site.RelAutonomy)
+		val["rel_self_consumption"] = roundPercent(meas.Site.RelSelfConsumption)
+	}
+	if autonomy, ok := day.Autonomy(); ok {
+		val["day_autonomy"] = autonomy
+	}
+	if rate, ok := day.SelfConsumptionRate(); ok {
+		val["day_self_consumption"] = rate
+	}
+	return val
+}
+
+func roundPercent(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// dcInputReport reports the power, voltage and current of a DC input.
+func dcInputReport(input model.DCInput) map[string]float64 {
+	val := make(map[string]float64)
+	val["dc_p"] = input.Power
+	val["dc_u"] = input.Voltage
+	val["dc_i"] = input.Current
+	return val
+}
+
+// findDCInput returns the DC input with the given service address, e.g. 1_2.
+func findDCInput(meas *model.Measurements, address string) (model.DCInput, bool) {
+	for _, inv := range meas.DevicesOfType(model.DeviceTypeInverter) {
+		for _, input := range inv.DCInputs {
+			if model.DCInputAddress(inv.ID, input.Index) == address {
+				return input, true
+			}
+		}
+	}
+	return model.DCInput{}, false
+}
+
+// batteryChargeReport reports charging as import and discharging as export.
+func batteryChargeReport(meas *model.Measurements) map[string]float64 {
+	val := make(map[string]float64)
+	val["p_import"] = math.Max(-meas.Site.PowerBattery, 0)
+	val["p_export"] = math.Max(meas.Site.PowerBattery, 0)
+	return val
+}
+
+func batteryMode(meas *model.Measurements) string {
+	switch {
+	case meas.Site.PowerBattery < 0:
+		return "charging"
+	case meas.Site.PowerBattery > 0:
+		return "discharging"
+	}
+	return "idle"
+}
+
+// batteryLevel returns the state of charge of the first inverter with a battery attached.
+func batteryLevel(meas *model.Measurements) int64 {
+	for _, inv := range meas.DevicesOfType(model.DeviceTypeInverter) {
+		if inv.Soc > 0 {
+			return int64(math.Round(inv.Soc))
+		}
+	}
+	return 0
+}
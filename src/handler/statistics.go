@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/model"
+)
+
+// statisticsDateLayouts are the accepted formats of from and to in a statistics query, dates
+// without time zone are local time.
+var statisticsDateLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02", "2006-01"}
+
+// SetStatistics gives the router access to the energy statistics, so they can be queried.
+func (fc *FromFimpRouter) SetStatistics(statistics *model.Statistics) {
+	fc.statistics = statistics
+}
+
+// respondWithStatistics answers cmd.app.get_statistics. The request is a str_map with period
+// hour, day or month and optional from and to, without them the current day, month or year is
+// reported.
+func (fc *FromFimpRouter) respondWithStatistics(newMsg *fimpgo.Message, adr *fimpgo.Address) {
+	report, err := fc.queryStatistics(newMsg.Payload)
+	if err != nil {
+		log.Warn("<fimp> Statistics query rejected: ", err)
+		report.Error = err.Error()
+	}
+	msg := fimpgo.NewMessage("evt.app.statistics_report", model.ServiceName, fimpgo.VTypeObject, report, nil, nil, newMsg.Payload)
+	if err := fc.respond(newMsg.Payload, msg); err != nil {
+		fc.publish(adr, msg)
+	}
+}
+
+// dayTotals returns the energy flows of the current day, empty if no statistics are collected.
+func (fc *FromFimpRouter) dayTotals() model.EnergyTotals {
+	if fc.statistics == nil {
+		return model.EnergyTotals{}
+	}
+	return fc.statistics.Current(model.PeriodDay)
+}
+
+func (fc *FromFimpRouter) queryStatistics(request *fimpgo.FimpMessage) (model.StatisticsReport, error) {
+	if fc.statistics == nil {
+		return model.StatisticsReport{}, fmt.Errorf("statistics aren't collected")
+	}
+	params := map[string]string{}
+	if request.ValueType == fimpgo.VTypeStrMap {
+		var err error
+		if params, err = request.GetStrMapValue(); err != nil {
+			return model.StatisticsReport{}, err
+		}
+	}
+	period := params["period"]
+	if period == "" {
+		period = model.PeriodDay
+	}
+	from, to := model.DefaultRange(period, time.Now())
+	var err error
+	if params["from"] != "" {
+		if from, err = parseStatisticsDate(params["from"]); err != nil {
+			return model.StatisticsReport{Period: period}, err
+		}
+	}
+	if params["to"] != "" {
+		if to, err = parseStatisticsDate(params["to"]); err != nil {
+			return model.StatisticsReport{Period: period}, err
+		}
+	}
+	return fc.statistics.Query(period, from, to)
+}
+
+func parseStatisticsDate(value string) (time.Time, error) {
+	for _, layout := range statisticsDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse date %q, expected e.g. 2006-01-02", value)
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type configWrite struct {
+	path string
+	body string
+}
+
+// systemActions are the battery and export limit actions, by the name of their cmd.system.* command.
+// Each action is a sequence of writes to the config API of the Datamanager.
+var systemActions = map[string][]configWrite{
+	"forced_battery_storage_prestart": {
+		{"/config/batteries", `{"HYB_EVU_CHARGEFROMGRID":true}`},
+		{"/config/batteries", `{"HYB_EM_POWER":-50000,"HYB_EM_MODE":1}`},
+	},
+	"forced_battery_storage": {
+		{"/config/batteries", `{"HYB_EM_POWER":50000,"HYB_EM_MODE":1}`},
+	},
+	"forced_battery_storage_finished": {
+		{"/config/batteries", `{"HYB_EVU_CHARGEFROMGRID":false}`},
+		{"/config/batteries", `{"HYB_EM_POWER":0,"HYB_EM_MODE":1}`},
+	},
+	"excess_solar_production_disabled": {
+		{"/config/exportlimit", `{"DPL_ON":true,"DPL_WPEAK":5000,"DPL_WLIM_USE_ABS":true,"DPL_WLIM_ABS":0}`},
+	},
+	"excess_solar_production_enabled": {
+		{"/config/exportlimit", `{"DPL_ON":false}`},
+	},
+}
+
+// SystemActionNames returns the names of the actions RunSystemAction accepts.
+func SystemActionNames() []string {
+	names := make([]string, 0, len(systemActions))
+	for name := range systemActions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RunSystemAction writes the settings of the named action to the Datamanager. All writes are
+// attempted, the error names the ones that failed.
+func (fc *FromFimpRouter) RunSystemAction(name string) error {
+	writes, ok := systemActions[name]
+	if !ok {
+		return fmt.Errorf("unknown action %s", name)
+	}
+	log.Info("<fimp> Running action ", name)
+	url := "http://" + fc.configs.Host
+	var failed []string
+	for _, write := range writes {
+		if !digestPost(url, write.path, []byte(write.body)) {
+			failed = append(failed, write.path)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("action %s failed, write to %v not accepted", name, failed)
+	}
+	return nil
+}
@@ -2,10 +2,14 @@ package model
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/futurehomeno/fimpgo/edgeapp"
@@ -15,29 +19,398 @@ import (
 
 const ServiceName = "fronius"
 
+const (
+	DefaultReportHeartbeatSec    = 300
+	DefaultPollTimeSec           = 5
+	DefaultEnergyPollTimeSec     = 60
+	DefaultDeviceInfoPollTimeSec = 3600
+	DefaultMinMaxPollTimeSec     = 900
+	DefaultNightPollTimeSec      = 300
+	DefaultMaxSitePowerW         = 100000
+	DefaultOfflineAfterFailures  = 3
+	DefaultRequestTimeoutSec     = 10
+	DefaultMaxBackoffSec         = 300
+	DefaultStateSaveIntervalSec  = 300
+	DefaultMetricsAddress        = ":9469"
+	DefaultAPIAddress            = ":9470"
+	DefaultHomeAssistantPrefix   = "homeassistant"
+)
+
+// Lower limits of the poll intervals, the web server of the Datamanager is easily overloaded.
+const (
+	MinPollTimeSec           = 2
+	MinDeviceInfoPollTimeSec = 60
+)
+
+const (
+	InverterTypeHybrid    = "hybrid"
+	InverterTypeNotHybrid = "not_hybrid"
+	// InverterTypeNotSet is the manifest default until the user picks a type
+	InverterTypeNotSet = "nothing"
+)
+
+var hostnameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,62})(\.[a-zA-Z0-9-]{1,63})*$`)
+
+// ConfigSchemaVersion is the version of config.json written by this version of the adapter.
+const ConfigSchemaVersion = 1
+
+// configMigrations upgrade config.json, the migration at index i upgrades version i to i+1.
+var configMigrations = []migration{
+	// 1: older versions accepted the host as URL, it has to be host[:port]
+	func(doc map[string]interface{}) {
+		if host, ok := doc["host"].(string); ok {
+			host = strings.TrimPrefix(strings.TrimPrefix(host, "http://"), "https://")
+			doc["host"] = strings.SplitN(host, "/", 2)[0]
+		}
+	},
+}
+
 type Configs struct {
-	path               string
-	InstanceAddress    string `json:"instance_address"`
-	MqttServerURI      string `json:"mqtt_server_uri"`
-	MqttUsername       string `json:"mqtt_server_username"`
-	MqttPassword       string `json:"mqtt_server_password"`
-	MqttClientIdPrefix string `json:"mqtt_client_id_prefix"`
-	LogFile            string `json:"log_file"`
-	LogLevel           string `json:"log_level"`
-	LogFormat          string `json:"log_format"`
-	WorkDir            string `json:"-"`
-	ConfiguredAt       string `json:"configured_at"`
-	ConfiguredBy       string `json:"configured_by"`
-	Param1             bool   `json:"param_1"`
-	Param2             string `json:"param_2"`
-	PollTimeSec        int    `json:"poll_time_sec"`
-	StateDir           string `json:"state_dir"`
-	Host               string `json:"host"`
-	Type               string `json:"type"`
-	Value1             string `json:"value1"`
-	Value2             string `json:"value2"`
-	Username           string `json:"username"`
-	Password           string `json:"password"`
+	path                  string
+	SchemaVersion         int                 `json:"schema_version"`
+	InstanceAddress       string              `json:"instance_address"`
+	MqttServerURI         string              `json:"mqtt_server_uri"`
+	MqttUsername          string              `json:"mqtt_server_username"`
+	MqttPassword          string              `json:"mqtt_server_password"`
+	MqttClientIdPrefix    string              `json:"mqtt_client_id_prefix"`
+	LogFile               string              `json:"log_file"`
+	LogLevel              string              `json:"log_level"`
+	LogFormat             string              `json:"log_format"`
+	WorkDir               string              `json:"-"`
+	ConfiguredAt          string              `json:"configured_at"`
+	ConfiguredBy          string              `json:"configured_by"`
+	Param1                bool                `json:"param_1"`
+	Param2                string              `json:"param_2"`
+	PollTimeSec           int                 `json:"poll_time_sec"`
+	EnergyPollTimeSec     int                 `json:"energy_poll_time_sec"`
+	DeviceInfoPollTimeSec int                 `json:"device_info_poll_time_sec"`
+	MinMaxPollTimeSec     int                 `json:"min_max_poll_time_sec"`
+	StateDir              string              `json:"state_dir"`
+	Host                  string              `json:"host"`
+	Type                  string              `json:"type"`
+	Value1                string              `json:"value1"`
+	Value2                string              `json:"value2"`
+	Username              string              `json:"username"`
+	Password              string              `json:"password"`
+	NightPollTimeSec      int                 `json:"night_poll_time_sec"`
+	MaxSitePowerW         float64             `json:"max_site_power_w"`
+	Latitude              float64             `json:"latitude"`
+	Longitude             float64             `json:"longitude"`
+	CaptureEnabled        bool                `json:"capture_enabled"`
+	ReplayFile            string              `json:"replay_file"`
+	ReportHeartbeatSec    int                 `json:"report_heartbeat_sec"`
+	OfflineAfterFailures  int                 `json:"offline_after_failures"`
+	RequestTimeoutSec     int                 `json:"request_timeout_sec"`
+	MaxBackoffSec         int                 `json:"max_backoff_sec"`
+	StateSaveIntervalSec  int                 `json:"state_save_interval_sec"`
+	MetricsEnabled        bool                `json:"metrics_enabled"`
+	MetricsAddress        string              `json:"metrics_address"`
+	APIEnabled            bool                `json:"api_enabled"`
+	APIAddress            string              `json:"api_address"`
+	APIToken              string              `json:"api_token"`
+	HomeAssistantEnabled  bool                `json:"ha_discovery_enabled"`
+	HomeAssistantPrefix   string              `json:"ha_discovery_prefix"`
+	Influx                InfluxConfig        `json:"influx"`
+	GridQuality           GridQualityConfig   `json:"grid_quality"`
+	ReportDeadband        Deadband            `json:"report_deadband"`
+	ReportDeadbands       map[string]Deadband `json:"report_deadbands"`
+}
+
+// PowerPollTime returns the poll interval of power values, at least MinPollTimeSec.
+func (cf *Configs) PowerPollTime() time.Duration {
+	switch {
+	case cf.PollTimeSec <= 0:
+		return DefaultPollTimeSec * time.Second
+	case cf.PollTimeSec < MinPollTimeSec:
+		return MinPollTimeSec * time.Second
+	}
+	return time.Duration(cf.PollTimeSec) * time.Second
+}
+
+// EnergyPollTime returns how often energy counters are updated. They are read together with
+// power values, so it's never shorter than the power poll interval.
+func (cf *Configs) EnergyPollTime() time.Duration {
+	interval := DefaultEnergyPollTimeSec * time.Second
+	if cf.EnergyPollTimeSec > 0 {
+		interval = time.Duration(cf.EnergyPollTimeSec) * time.Second
+	}
+	if power := cf.PowerPollTime(); interval < power {
+		return power
+	}
+	return interval
+}
+
+// DeviceInfoPollTime returns how often the device list of the Datamanager is read, at least MinDeviceInfoPollTimeSec.
+func (cf *Configs) DeviceInfoPollTime() time.Duration {
+	switch {
+	case cf.DeviceInfoPollTimeSec <= 0:
+		return DefaultDeviceInfoPollTimeSec * time.Second
+	case cf.DeviceInfoPollTimeSec < MinDeviceInfoPollTimeSec:
+		return MinDeviceInfoPollTimeSec * time.Second
+	}
+	return time.Duration(cf.DeviceInfoPollTimeSec) * time.Second
+}
+
+// MinMaxPollTime returns how often the min/max values of the inverters are read, at least MinDeviceInfoPollTimeSec.
+func (cf *Configs) MinMaxPollTime() time.Duration {
+	switch {
+	case cf.MinMaxPollTimeSec <= 0:
+		return DefaultMinMaxPollTimeSec * time.Second
+	case cf.MinMaxPollTimeSec < MinDeviceInfoPollTimeSec:
+		return MinDeviceInfoPollTimeSec * time.Second
+	}
+	return time.Duration(cf.MinMaxPollTimeSec) * time.Second
+}
+
+// NightPollTime returns the poll interval used while the inverters sleep.
+func (cf *Configs) NightPollTime() time.Duration {
+	if cf.NightPollTimeSec <= 0 {
+		return DefaultNightPollTimeSec * time.Second
+	}
+	return time.Duration(cf.NightPollTimeSec) * time.Second
+}
+
+// MaxSitePower returns the highest power in W the site can produce, used to detect energy counter glitches.
+func (cf *Configs) MaxSitePower() float64 {
+	if cf.MaxSitePowerW <= 0 {
+		return DefaultMaxSitePowerW
+	}
+	return cf.MaxSitePowerW
+}
+
+// OfflineAfter returns after how many failed polls in a row the inverter is reported offline.
+func (cf *Configs) OfflineAfter() int {
+	if cf.OfflineAfterFailures <= 0 {
+		return DefaultOfflineAfterFailures
+	}
+	return cf.OfflineAfterFailures
+}
+
+// RequestTimeout returns how long a single request to the Datamanager may take.
+func (cf *Configs) RequestTimeout() time.Duration {
+	if cf.RequestTimeoutSec <= 0 {
+		return DefaultRequestTimeoutSec * time.Second
+	}
+	return time.Duration(cf.RequestTimeoutSec) * time.Second
+}
+
+// MaxBackoff returns the longest interval between attempts while the Datamanager keeps failing.
+func (cf *Configs) MaxBackoff() time.Duration {
+	interval := DefaultMaxBackoffSec * time.Second
+	if cf.MaxBackoffSec > 0 {
+		interval = time.Duration(cf.MaxBackoffSec) * time.Second
+	}
+	if power := cf.PowerPollTime(); interval < power {
+		return power
+	}
+	return interval
+}
+
+// StateSaveInterval returns how often state.json is written while polling.
+func (cf *Configs) StateSaveInterval() time.Duration {
+	if cf.StateSaveIntervalSec <= 0 {
+		return DefaultStateSaveIntervalSec * time.Second
+	}
+	return time.Duration(cf.StateSaveIntervalSec) * time.Second
+}
+
+// MetricsListenAddress returns the address the metrics endpoint listens on.
+func (cf *Configs) MetricsListenAddress() string {
+	if cf.MetricsAddress == "" {
+		return DefaultMetricsAddress
+	}
+	return cf.MetricsAddress
+}
+
+// APIListenAddress returns the address the local REST API listens on.
+func (cf *Configs) APIListenAddress() string {
+	if cf.APIAddress == "" {
+		return DefaultAPIAddress
+	}
+	return cf.APIAddress
+}
+
+// HomeAssistantDiscoveryPrefix returns the topic prefix Home Assistant discovers entities on.
+func (cf *Configs) HomeAssistantDiscoveryPrefix() string {
+	if cf.HomeAssistantPrefix == "" {
+		return DefaultHomeAssistantPrefix
+	}
+	return cf.HomeAssistantPrefix
+}
+
+// HomeAssistantStateTopic returns the topic the state of a Home Assistant device is published on.
+func (cf *Configs) HomeAssistantStateTopic(device string) string {
+	instance := cf.InstanceAddress
+	if instance == "" {
+		instance = "1"
+	}
+	return fmt.Sprintf("%s/%s/%s", ServiceName, instance, device)
+}
+
+// HasLocation returns true if site coordinates are configured and can be used for sunrise and sunset hints.
+func (cf *Configs) HasLocation() bool {
+	return cf.Latitude != 0 || cf.Longitude != 0
+}
+
+// ReportHeartbeat returns the longest time a report may be held back by the deadbands.
+func (cf *Configs) ReportHeartbeat() time.Duration {
+	if cf.ReportHeartbeatSec <= 0 {
+		return DefaultReportHeartbeatSec * time.Second
+	}
+	return time.Duration(cf.ReportHeartbeatSec) * time.Second
+}
+
+// Deadband defines how much a reported value has to change before a new report is sent.
+// Abs is in the unit of the value, Rel is a fraction of the last reported value.
+type Deadband struct {
+	Abs float64 `json:"abs"`
+	Rel float64 `json:"rel"`
+}
+
+// Exceeded returns true if the change from last to current is outside of the deadband.
+// A change has to exceed every configured band, a zero deadband only suppresses identical values.
+func (d Deadband) Exceeded(last, current float64) bool {
+	delta := math.Abs(current - last)
+	if delta == 0 {
+		return false
+	}
+	if d.Abs > 0 && delta <= d.Abs {
+		return false
+	}
+	if d.Rel > 0 && delta <= d.Rel*math.Abs(last) {
+		return false
+	}
+	return true
+}
+
+// DeadbandFor returns the deadband configured for a value, falling back to the default one.
+func (cf *Configs) DeadbandFor(name string) Deadband {
+	if db, ok := cf.ReportDeadbands[name]; ok {
+		return db
+	}
+	return cf.ReportDeadband
+}
+
+// Defaults of the InfluxDB export
+const (
+	DefaultInfluxSiteMeasurement   = "fronius_site"
+	DefaultInfluxDeviceMeasurement = "fronius_device"
+	DefaultInfluxFlushIntervalSec  = 60
+	DefaultInfluxBatchSize         = 500
+	DefaultInfluxBufferSize        = 50000
+	DefaultInfluxFileMaxSizeMB     = 10
+)
+
+// InfluxConfig configures the export of measurements in InfluxDB line protocol. Lines are posted
+// to URL, e.g. http://influxdb:8086/api/v2/write?org=home&bucket=solar, or written to rotating
+// files in the data dir if no URL is set.
+type InfluxConfig struct {
+	Enabled           bool              `json:"enabled"`
+	URL               string            `json:"url"`
+	Token             string            `json:"token"`
+	SiteMeasurement   string            `json:"site_measurement"`
+	DeviceMeasurement string            `json:"device_measurement"`
+	Tags              map[string]string `json:"tags"`
+	FlushIntervalSec  int               `json:"flush_interval_sec"`
+	BatchSize         int               `json:"batch_size"`
+	BufferSize        int               `json:"buffer_size"`
+	FileMaxSizeMB     int               `json:"file_max_size_mb"`
+}
+
+func (ic InfluxConfig) SiteMeasurementName() string {
+	if ic.SiteMeasurement == "" {
+		return DefaultInfluxSiteMeasurement
+	}
+	return ic.SiteMeasurement
+}
+
+func (ic InfluxConfig) DeviceMeasurementName() string {
+	if ic.DeviceMeasurement == "" {
+		return DefaultInfluxDeviceMeasurement
+	}
+	return ic.DeviceMeasurement
+}
+
+// FlushInterval returns how often buffered lines are written.
+func (ic InfluxConfig) FlushInterval() time.Duration {
+	if ic.FlushIntervalSec <= 0 {
+		return DefaultInfluxFlushIntervalSec * time.Second
+	}
+	return time.Duration(ic.FlushIntervalSec) * time.Second
+}
+
+// MaxBatch returns how many lines are written with one request.
+func (ic InfluxConfig) MaxBatch() int {
+	if ic.BatchSize <= 0 {
+		return DefaultInfluxBatchSize
+	}
+	return ic.BatchSize
+}
+
+// MaxBuffered returns how many lines are kept while the target is unavailable, the oldest are dropped first.
+func (ic InfluxConfig) MaxBuffered() int {
+	if ic.BufferSize <= 0 {
+		return DefaultInfluxBufferSize
+	}
+	return ic.BufferSize
+}
+
+func (ic InfluxConfig) FileMaxSize() int {
+	if ic.FileMaxSizeMB <= 0 {
+		return DefaultInfluxFileMaxSizeMB
+	}
+	return ic.FileMaxSizeMB
+}
+
+// Defaults of the grid quality monitor, the limits of EN 50160 for low voltage grids
+const (
+	DefaultGridNominalVoltageV     = 230
+	DefaultGridVoltageTolerancePct = 10
+	DefaultGridFrequencyMinHz      = 49.5
+	DefaultGridFrequencyMaxHz      = 50.5
+	DefaultGridMaxEvents           = 1000
+)
+
+// GridQualityConfig sets the limits of the grid voltage and frequency. Values beyond them are
+// logged as grid events.
+type GridQualityConfig struct {
+	NominalVoltageV     float64 `json:"nominal_voltage_v"`
+	VoltageTolerancePct float64 `json:"voltage_tolerance_pct"`
+	FrequencyMinHz      float64 `json:"frequency_min_hz"`
+	FrequencyMaxHz      float64 `json:"frequency_max_hz"`
+	MaxEvents           int     `json:"max_events"`
+}
+
+// VoltageLimits returns the lowest and highest allowed voltage, the nominal voltage ± the tolerance.
+func (gc GridQualityConfig) VoltageLimits() (float64, float64) {
+	nominal, tolerance := gc.NominalVoltageV, gc.VoltageTolerancePct
+	if nominal <= 0 {
+		nominal = DefaultGridNominalVoltageV
+	}
+	if tolerance <= 0 {
+		tolerance = DefaultGridVoltageTolerancePct
+	}
+	return math.Round(nominal*(100-tolerance)) / 100, math.Round(nominal*(100+tolerance)) / 100
+}
+
+// FrequencyLimits returns the lowest and highest allowed frequency.
+func (gc GridQualityConfig) FrequencyLimits() (float64, float64) {
+	min, max := gc.FrequencyMinHz, gc.FrequencyMaxHz
+	if min <= 0 {
+		min = DefaultGridFrequencyMinHz
+	}
+	if max <= 0 {
+		max = DefaultGridFrequencyMaxHz
+	}
+	return min, max
+}
+
+// MaxEventCount returns how many grid events are kept, the oldest are dropped first.
+func (gc GridQualityConfig) MaxEventCount() int {
+	if gc.MaxEvents <= 0 {
+		return DefaultGridMaxEvents
+	}
+	return gc.MaxEvents
 }
 
 func NewConfigs(workDir string) *Configs {
@@ -55,33 +428,72 @@ func NewConfigs(workDir string) *Configs {
 	return conf
 }
 
+// LoadFromFile loads and if needed migrates config.json. A corrupt file is replaced by the default config.
 func (cf *Configs) LoadFromFile() error {
-	configFileBody, err := ioutil.ReadFile(cf.path)
-	if err != nil {
-		return err
+	migrated, err := loadVersioned(cf.path, configMigrations, cf)
+	if errors.Is(err, errCorrupt) {
+		if err := restoreDefaults(cf.path, filepath.Join(cf.WorkDir, "defaults", "config.json"), err); err != nil {
+			return err
+		}
+		migrated, err = loadVersioned(cf.path, configMigrations, cf)
 	}
-	err = json.Unmarshal(configFileBody, cf)
 	if err != nil {
 		return err
 	}
+	if migrated {
+		log.Info("<model> Config migrated to schema version ", ConfigSchemaVersion)
+		return cf.SaveToFile()
+	}
 	return nil
 }
 
 func (cf *Configs) SaveToFile() error {
+	cf.SchemaVersion = ConfigSchemaVersion
 	cf.ConfiguredBy = "auto"
 	cf.ConfiguredAt = time.Now().Format(time.RFC3339)
 	bpayload, err := json.Marshal(cf)
-	err = ioutil.WriteFile(cf.path, bpayload, 0664)
 	if err != nil {
 		return err
 	}
-	return err
+	return utils.WriteFileAtomic(cf.path, bpayload, 0664)
 }
 
 func (cf *Configs) GetDataDir() string {
 	return filepath.Join(cf.WorkDir, "data")
 }
 
+// GetCaptureFile returns the file raw Solar API responses are captured to.
+func (cf *Configs) GetCaptureFile() string {
+	return filepath.Join(cf.GetDataDir(), "capture.jsonl")
+}
+
+// GetReplayFile returns the capture file to replay, relative paths are resolved against the data dir.
+func (cf *Configs) GetReplayFile() string {
+	if cf.ReplayFile == "" || filepath.IsAbs(cf.ReplayFile) {
+		return cf.ReplayFile
+	}
+	return filepath.Join(cf.GetDataDir(), cf.ReplayFile)
+}
+
+// GetInfluxFile returns the file line protocol is written to when no InfluxDB URL is configured.
+func (cf *Configs) GetInfluxFile() string {
+	return filepath.Join(cf.GetDataDir(), "influx", "measurements.lp")
+}
+
+// IsReplay returns true if responses are replayed from a capture file instead of a live host.
+func (cf *Configs) IsReplay() bool {
+	return cf.ReplayFile != ""
+}
+
+// Redacted returns a copy of the configs without the passwords, the api_token and the InfluxDB
+// token, as they are reported to the hub. Anyone on the broker can read those reports.
+func (cf *Configs) Redacted() Configs {
+	redacted := *cf
+	redacted.MqttPassword, redacted.Password, redacted.APIToken = "", "", ""
+	redacted.Influx.Token = ""
+	return redacted
+}
+
 func (cf *Configs) GetDefaultDir() string {
 	return filepath.Join(cf.WorkDir, "defaults")
 }
@@ -94,12 +506,36 @@ func (cf *Configs) LoadDefaults() error {
 	return utils.CopyFile(defaultConfigFile, configFile)
 }
 
+// ValidateInverter checks the inverter settings that can be changed with cmd.config.extended_set.
+func (cf *Configs) ValidateInverter() error {
+	switch cf.Type {
+	case InverterTypeHybrid, InverterTypeNotHybrid, InverterTypeNotSet, "":
+	default:
+		return fmt.Errorf("unsupported inverter type '%s'", cf.Type)
+	}
+	host := cf.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if net.ParseIP(host) == nil && !hostnameRegexp.MatchString(host) {
+		return fmt.Errorf("invalid host '%s'", cf.Host)
+	}
+	return nil
+}
+
+// IsConfigured returns true when the inverter type and host are set, in replay mode the host isn't needed.
 func (cf *Configs) IsConfigured() bool {
-	// TODO : Add logic here
-	return true
+	if cf.Type != InverterTypeHybrid && cf.Type != InverterTypeNotHybrid {
+		return false
+	}
+	return cf.IsReplay() || (cf.Host != "" && cf.Host != "host_ip")
 }
 
 type ConfigReport struct {
-	OpStatus string             `json:"op_status"`
-	AppState *edgeapp.AppStates `json:"app_state"`
+	OpStatus  string             `json:"op_status"`
+	AppState  *edgeapp.AppStates `json:"app_state"`
+	ErrorText string             `json:"error_text,omitempty"`
 }
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// CounterPV is the key of the lifetime PV production counter of the site.
+	CounterPV = "pv"
+	// CounterLoad is the key of the house consumption counter, which the adapter integrates itself.
+	CounterLoad = "load"
+
+	counterConfirmations = 3
+	counterToleranceWh   = 100
+)
+
+// EnergyCounter follows a monotonic lifetime energy counter (Wh) reported by the inverter.
+// Values going backwards or jumping further than the site can produce are held back until they
+// are confirmed by consecutive readings, and are then taken as the new baseline without a delta.
+// The energy of a confirmed jump isn't counted, the returned error tells how much that is.
+type EnergyCounter struct {
+	Total     float64   `json:"total"`
+	Reported  float64   `json:"reported"`
+	ChangedAt time.Time `json:"changed_at"`
+	Suspect   int       `json:"suspect"`
+	// Power and SampledAt are the previous sample of an integrated counter.
+	Power     float64   `json:"power,omitempty"`
+	SampledAt time.Time `json:"sampled_at,omitempty"`
+}
+
+// Update feeds a new reading into the counter and returns the accepted delta in Wh.
+// An error is returned for readings that were rejected as glitch or taken as counter reset.
+func (c *EnergyCounter) Update(total float64, at time.Time, maxPowerW float64) (float64, error) {
+	if total <= 0 {
+		return 0, nil
+	}
+	if c.ChangedAt.IsZero() {
+		c.rebase(total, at)
+		return 0, nil
+	}
+	delta := total - c.Total
+	maxDelta := maxPowerW*at.Sub(c.ChangedAt).Hours() + counterToleranceWh
+	if delta >= 0 && delta <= maxDelta {
+		c.Suspect = 0
+		if delta > 0 {
+			c.Total = total
+			c.ChangedAt = at
+		}
+		return delta, nil
+	}
+
+	c.Suspect++
+	if c.Suspect < counterConfirmations {
+		return 0, fmt.Errorf("energy counter glitch ignored, %.0f Wh -> %.0f Wh", c.Total, total)
+	}
+	previous := c.Total
+	c.rebase(total, at)
+	if total > previous {
+		return 0, fmt.Errorf("energy counter jumped, %.0f Wh -> %.0f Wh taken as new baseline, %.0f Wh not counted", previous, total, total-previous)
+	}
+	return 0, fmt.Errorf("energy counter reset, %.0f Wh -> %.0f Wh", previous, total)
+}
+
+// Integrate counts up the energy since the previous sample, with the power of the previous sample
+// in W, and returns the delta in Wh. Nothing is counted over gaps longer than maxSampleGap, e.g.
+// while the inverter couldn't be reached.
+func (c *EnergyCounter) Integrate(powerW float64, at time.Time) float64 {
+	if c.ChangedAt.IsZero() {
+		c.ChangedAt = at
+	}
+	var delta float64
+	if gap := at.Sub(c.SampledAt); !c.SampledAt.IsZero() && gap > 0 && gap <= maxSampleGap {
+		delta = c.Power * gap.Hours()
+		c.Total += delta
+		c.ChangedAt = at
+	}
+	c.Power = powerW
+	c.SampledAt = at
+	return delta
+}
+
+// Unreported returns the energy in Wh counted since the last report.
+func (c *EnergyCounter) Unreported() float64 {
+	if c.Total < c.Reported {
+		return 0
+	}
+	return c.Total - c.Reported
+}
+
+func (c *EnergyCounter) IsValid() bool {
+	return !c.ChangedAt.IsZero()
+}
+
+func (c *EnergyCounter) rebase(total float64, at time.Time) {
+	c.Total = total
+	c.Reported = total
+	c.ChangedAt = at
+	c.Suspect = 0
+}
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnergyCounterJump(t *testing.T) {
+	start := time.Date(2026, 7, 1, 12, 0, 0, 0, time.Local)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	counter := EnergyCounter{}
+	counter.Update(1000000, at(0), 5000)
+	if delta, err := counter.Update(1000400, at(5), 5000); delta != 400 || err != nil {
+		t.Fatalf("unexpected delta %v %v", delta, err)
+	}
+
+	// 50 kWh in 5 minutes is more than a 5 kW site produces, it's held back until confirmed
+	for i := 1; i < counterConfirmations; i++ {
+		if delta, err := counter.Update(1050400, at(5+i), 5000); delta != 0 || err == nil || counter.Total != 1000400 {
+			t.Fatalf("jump not held back %v %v %+v", delta, err, counter)
+		}
+	}
+	// confirmed it's the new baseline, the energy of the jump isn't counted and the error tells how much it is
+	delta, err := counter.Update(1050400, at(5+counterConfirmations), 5000)
+	if delta != 0 || err == nil || !strings.Contains(err.Error(), "50000 Wh not counted") {
+		t.Fatalf("unexpected rebase %v %v", delta, err)
+	}
+	if counter.Total != 1050400 || counter.Unreported() != 0 {
+		t.Errorf("unexpected baseline %+v", counter)
+	}
+	if delta, err := counter.Update(1050500, at(10), 5000); delta != 100 || err != nil {
+		t.Errorf("not counting from the new baseline %v %v", delta, err)
+	}
+
+	// a counter going backwards was replaced, nothing is lost
+	for i := 0; i < counterConfirmations; i++ {
+		_, err = counter.Update(2000, at(11+i), 5000)
+	}
+	if err == nil || strings.Contains(err.Error(), "not counted") || counter.Total != 2000 {
+		t.Errorf("unexpected reset %v %+v", err, counter)
+	}
+}
@@ -0,0 +1,250 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/utils"
+)
+
+// GridEventsSchemaVersion is the version of grid_events.json written by this version of the adapter.
+const GridEventsSchemaVersion = 1
+
+var gridEventsMigrations = []migration{
+	// 1: first version
+	func(doc map[string]interface{}) {},
+}
+
+// Kinds of grid events
+const (
+	GridOvervoltage    = "overvoltage"
+	GridUndervoltage   = "undervoltage"
+	GridOverfrequency  = "overfrequency"
+	GridUnderfrequency = "underfrequency"
+)
+
+// GridEvent is an excursion of the grid voltage or frequency beyond the configured limits, as
+// measured by Source, e.g. inverter:1 or meter:L2 for the second phase of the meter. Extreme is
+// the highest or lowest value while it lasted and Limit the limit that was crossed. While the
+// event is active End is the last poll the value was beyond the limit.
+type GridEvent struct {
+	Kind     string    `json:"kind"`
+	Source   string    `json:"source"`
+	Unit     string    `json:"unit"`
+	Limit    float64   `json:"limit"`
+	Extreme  float64   `json:"extreme"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration_sec"`
+	Active   bool      `json:"active"`
+}
+
+func (e *GridEvent) key() string {
+	return e.Source + "/" + e.Unit
+}
+
+// exceeds returns true if value is further beyond the limit than the extreme so far.
+func (e *GridEvent) exceeds(value float64) bool {
+	if e.Kind == GridOvervoltage || e.Kind == GridOverfrequency {
+		return value > e.Extreme
+	}
+	return value < e.Extreme
+}
+
+// GridLimits are the limits grid values are checked against.
+type GridLimits struct {
+	VoltageMin   float64 `json:"u_min"`
+	VoltageMax   float64 `json:"u_max"`
+	FrequencyMin float64 `json:"f_min"`
+	FrequencyMax float64 `json:"f_max"`
+}
+
+// GridEventsReport answers a query of the grid event log, events are sorted oldest first.
+type GridEventsReport struct {
+	Limits GridLimits  `json:"limits"`
+	From   time.Time   `json:"from"`
+	To     time.Time   `json:"to"`
+	Events []GridEvent `json:"events"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// gridSample is a grid value of a measurement, Unit is V or Hz.
+type gridSample struct {
+	source string
+	unit   string
+	value  float64
+}
+
+// GridEvents checks the grid voltage and frequency of every published measurement against the
+// configured limits and keeps a log of the excursions in data/grid_events.json.
+type GridEvents struct {
+	path          string
+	configs       *Configs
+	mux           sync.Mutex
+	SchemaVersion int          `json:"schema_version"`
+	Events        []*GridEvent `json:"events"`
+}
+
+func NewGridEvents(configs *Configs) *GridEvents {
+	return &GridEvents{configs: configs, path: filepath.Join(configs.GetDataDir(), "grid_events.json")}
+}
+
+// LoadFromFile loads grid_events.json if it exists. A corrupt file is moved aside and the log starts over.
+func (g *GridEvents) LoadFromFile() error {
+	if !utils.FileExists(g.path) {
+		return nil
+	}
+	_, err := loadVersioned(g.path, gridEventsMigrations, g)
+	if errors.Is(err, errCorrupt) {
+		log.Warn("<model> grid_events.json can't be read, starting over - ", err)
+		if err := os.Rename(g.path, g.path+".corrupt"); err != nil {
+			log.Warn("<model> Can't keep corrupt file - ", err)
+		}
+		return nil
+	}
+	return err
+}
+
+// SaveToFile writes grid_events.json right away.
+func (g *GridEvents) SaveToFile() error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return g.save()
+}
+
+func (g *GridEvents) save() error {
+	g.SchemaVersion = GridEventsSchemaVersion
+	body, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(g.path, body, 0664)
+}
+
+// Limits returns the configured limits.
+func (g *GridEvents) Limits() GridLimits {
+	limits := GridLimits{}
+	limits.VoltageMin, limits.VoltageMax = g.configs.GridQuality.VoltageLimits()
+	limits.FrequencyMin, limits.FrequencyMax = g.configs.GridQuality.FrequencyLimits()
+	return limits
+}
+
+// Check checks the grid values of meas and returns the events that started or ended with it.
+// Values that are 0 aren't known and don't end an event, an event not seen for longer than
+// maxSampleGap or of an inverter going to sleep ends with its last poll. The log is written
+// whenever an event starts or ends.
+func (g *GridEvents) Check(meas *Measurements) []GridEvent {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	limits := g.Limits()
+	active := make(map[string]*GridEvent)
+	for _, event := range g.Events {
+		if event.Active {
+			active[event.key()] = event
+		}
+	}
+	var changed []GridEvent
+	for key, event := range active {
+		asleep := meas.Sleeping && strings.HasPrefix(event.Source, DeviceTypeInverter+":")
+		if asleep || meas.Timestamp.Sub(event.End) > maxSampleGap {
+			event.Active = false
+			changed = append(changed, *event)
+			delete(active, key)
+		}
+	}
+	for _, sample := range gridSamples(meas) {
+		kind, limit := sample.check(limits)
+		key := sample.source + "/" + sample.unit
+		event := active[key]
+		if event != nil && event.Kind == kind {
+			if event.exceeds(sample.value) {
+				event.Extreme = sample.value
+			}
+			event.End = meas.Timestamp
+			event.Duration = event.End.Sub(event.Start).Seconds()
+			continue
+		}
+		if event != nil {
+			event.Active = false
+			changed = append(changed, *event)
+		}
+		if kind != "" {
+			event = &GridEvent{Kind: kind, Source: sample.source, Unit: sample.unit, Limit: limit, Extreme: sample.value,
+				Start: meas.Timestamp, End: meas.Timestamp, Active: true}
+			g.Events = append(g.Events, event)
+			changed = append(changed, *event)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if max := g.configs.GridQuality.MaxEventCount(); len(g.Events) > max {
+		g.Events = g.Events[len(g.Events)-max:]
+	}
+	if err := g.save(); err != nil {
+		log.Error("<model> Can't save grid events. Error: ", err)
+	}
+	return changed
+}
+
+// Query returns the events that started between from and to.
+func (g *GridEvents) Query(from, to time.Time) GridEventsReport {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	report := GridEventsReport{Limits: g.Limits(), From: from, To: to, Events: []GridEvent{}}
+	for _, event := range g.Events {
+		if !event.Start.Before(from) && event.Start.Before(to) {
+			report.Events = append(report.Events, *event)
+		}
+	}
+	return report
+}
+
+// gridSamples returns the grid values of meas. The values of sleeping inverters aren't current.
+func gridSamples(meas *Measurements) []gridSample {
+	var samples []gridSample
+	if !meas.Sleeping {
+		for _, dev := range meas.DevicesOfType(DeviceTypeInverter) {
+			source := DeviceTypeInverter + ":" + dev.ID
+			samples = append(samples, gridSample{source, "V", dev.VoltageAC}, gridSample{source, "Hz", dev.Frequency})
+		}
+	}
+	for i, voltage := range meas.Site.GridVoltages {
+		samples = append(samples, gridSample{fmt.Sprintf("%s:L%d", DeviceTypeMeter, i+1), "V", voltage})
+	}
+	samples = append(samples, gridSample{DeviceTypeMeter, "Hz", meas.Site.GridFrequency})
+	var known []gridSample
+	for _, sample := range samples {
+		if sample.value > 0 {
+			known = append(known, sample)
+		}
+	}
+	return known
+}
+
+// check returns the kind of event and the limit crossed, or an empty kind if the value is within the limits.
+func (s gridSample) check(limits GridLimits) (string, float64) {
+	if s.unit == "Hz" {
+		switch {
+		case s.value > limits.FrequencyMax:
+			return GridOverfrequency, limits.FrequencyMax
+		case s.value < limits.FrequencyMin:
+			return GridUnderfrequency, limits.FrequencyMin
+		}
+		return "", 0
+	}
+	switch {
+	case s.value > limits.VoltageMax:
+		return GridOvervoltage, limits.VoltageMax
+	case s.value < limits.VoltageMin:
+		return GridUndervoltage, limits.VoltageMin
+	}
+	return "", 0
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGridEvents(t *testing.T) {
+	workDir := newWorkDir(t)
+	defer os.RemoveAll(workDir)
+	configs := &Configs{WorkDir: workDir, GridQuality: GridQualityConfig{MaxEvents: 3}}
+	events := NewGridEvents(configs)
+
+	start := time.Date(2026, 7, 2, 13, 0, 0, 0, time.Local)
+	poll := func(i int, inverterVoltage float64, phases []float64, freq float64) []GridEvent {
+		meas := &Measurements{Timestamp: start.Add(time.Duration(i) * 5 * time.Second)}
+		meas.Devices = []DeviceMeasurement{{ID: "1", Type: DeviceTypeInverter, VoltageAC: inverterVoltage, Frequency: freq}}
+		meas.Site.GridVoltages, meas.Site.GridFrequency = phases, freq
+		return events.Check(meas)
+	}
+
+	if changed := poll(0, 238, []float64{236, 237, 239}, 50.01); len(changed) != 0 {
+		t.Fatalf("events within the limits %+v", changed)
+	}
+	// phase 3 is beyond 253 V for two polls
+	changed := poll(1, 249, []float64{240, 241, 254.2}, 50.02)
+	if len(changed) != 1 || changed[0].Kind != GridOvervoltage || changed[0].Source != "meter:L3" || !changed[0].Active || changed[0].Extreme != 254.2 {
+		t.Fatalf("unexpected start %+v", changed)
+	}
+	poll(2, 250, []float64{241, 242, 256.9}, 50.02)
+	// unknown values don't end an event
+	poll(3, 0, []float64{0, 0, 0}, 0)
+	changed = poll(4, 238, []float64{236, 237, 239}, 50.02)
+	if len(changed) != 1 || changed[0].Active || changed[0].Extreme != 256.9 || changed[0].Duration != 5 {
+		t.Fatalf("unexpected end %+v", changed)
+	}
+
+	// the inverter measures an underfrequency that isn't over before the inverter goes to sleep
+	changed = poll(5, 231, []float64{231, 232, 233}, 49.2)
+	if len(changed) != 2 || changed[0].Kind != GridUnderfrequency || changed[1].Kind != GridUnderfrequency {
+		t.Fatalf("unexpected underfrequency %+v", changed)
+	}
+	sleeping := &Measurements{Timestamp: start.Add(30 * time.Second), Sleeping: true}
+	sleeping.Site.GridFrequency = 49.3
+	changed = events.Check(sleeping)
+	if len(changed) != 1 || changed[0].Source != "inverter:1" || changed[0].Active {
+		t.Fatalf("inverter event not ended when it sleeps %+v", changed)
+	}
+
+	loaded := NewGridEvents(configs)
+	if err := loaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	report := loaded.Query(start, start.Add(time.Hour))
+	if len(report.Events) != 3 || report.Events[0].Source != "meter:L3" || report.Events[2].Source != "meter" {
+		t.Fatalf("unexpected log %+v", report.Events)
+	}
+	if report.Limits.VoltageMax != 253 || report.Limits.FrequencyMin != DefaultGridFrequencyMinHz {
+		t.Errorf("unexpected limits %+v", report.Limits)
+	}
+	// the meter event is still active after a restart and ends after a gap in the measurements
+	later := &Measurements{Timestamp: start.Add(time.Hour)}
+	changed = loaded.Check(later)
+	if len(changed) != 1 || changed[0].Source != "meter" || changed[0].Active || changed[0].Duration != 5 {
+		t.Errorf("unexpected end after a gap %+v", changed)
+	}
+}
@@ -0,0 +1,175 @@
+package model
+
+import "time"
+
+const (
+	DeviceTypeInverter = "inverter"
+	DeviceTypeMeter    = "meter"
+	DeviceTypeStorage  = "storage"
+)
+
+// Measurements is the normalised view of a site, independent of the API it was read from.
+// Power is in W and energy in Wh. Grid power is positive when importing and battery power
+// is positive when discharging, same as Fronius reports it.
+type Measurements struct {
+	Timestamp time.Time           `json:"timestamp"`
+	Source    string              `json:"source"`
+	Sleeping  bool                `json:"sleeping"`
+	Site      SiteMeasurements    `json:"site"`
+	Devices   []DeviceMeasurement `json:"devices"`
+}
+
+// SiteMeasurements are the power flows of the site. GridVoltages are the phase voltages in V and
+// GridFrequency the frequency in Hz measured by the meter at the feed-in point, if there is one.
+type SiteMeasurements struct {
+	PowerPV            float64   `json:"p_pv"`
+	PowerGrid          float64   `json:"p_grid"`
+	PowerLoad          float64   `json:"p_load"`
+	PowerBattery       float64   `json:"p_akku"`
+	HasGrid            bool      `json:"has_grid"`
+	HasLoad            bool      `json:"has_load"`
+	HasBattery         bool      `json:"has_battery"`
+	EnergyDay          float64   `json:"e_day"`
+	EnergyYear         float64   `json:"e_year"`
+	EnergyTotal        float64   `json:"e_total"`
+	RelAutonomy        float64   `json:"rel_autonomy"`
+	RelSelfConsumption float64   `json:"rel_self_consumption"`
+	GridVoltages       []float64 `json:"u_grid,omitempty"`
+	GridFrequency      float64   `json:"f_grid,omitempty"`
+}
+
+type DeviceMeasurement struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Power       float64   `json:"p"`
+	EnergyDay   float64   `json:"e_day"`
+	EnergyYear  float64   `json:"e_year"`
+	EnergyTotal float64   `json:"e_total"`
+	VoltageAC   float64   `json:"u_ac"`
+	CurrentAC   float64   `json:"i_ac"`
+	Frequency   float64   `json:"freq"`
+	VoltageDC   float64   `json:"u_dc"`
+	CurrentDC   float64   `json:"i_dc"`
+	StatusCode  int       `json:"status_code"`
+	Soc         float64   `json:"soc"`
+	BatteryMode float64   `json:"bat_mode"`
+	DCInputs    []DCInput `json:"dc_inputs,omitempty"`
+}
+
+// DCInput is one DC input (MPPT) of an inverter, numbered from 1. Voltage is in V, current in A
+// and power in W.
+type DCInput struct {
+	Index   int     `json:"index"`
+	Voltage float64 `json:"u"`
+	Current float64 `json:"i"`
+	Power   float64 `json:"p"`
+}
+
+// GridValues are what an inverter measures at its grid connection, the AC voltage in V, the AC
+// current in A and the frequency in Hz.
+type GridValues struct {
+	Voltage   float64 `json:"u_ac"`
+	Current   float64 `json:"i_ac"`
+	Frequency float64 `json:"freq"`
+}
+
+// InverterData is what is read from the CommonInverterData of an inverter, its DC inputs and its
+// grid values.
+type InverterData struct {
+	Grid     GridValues
+	DCInputs []DCInput
+}
+
+// DeviceIdentity identifies a device of the site as listed by the Datamanager.
+type DeviceIdentity struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	Serial      string `json:"serial"`
+	Name        string `json:"name"`
+	FroniusType int    `json:"fronius_type"`
+}
+
+func NewMeasurements(source string) *Measurements {
+	return &Measurements{Timestamp: time.Now(), Source: source}
+}
+
+// Asleep returns a copy of the measurements as they are while the inverters sleep. Production
+// is zeroed and values read through the logger are marked unknown, energy counters keep their
+// last known values.
+func (m *Measurements) Asleep() *Measurements {
+	meas := *m
+	meas.Timestamp = time.Now()
+	meas.Sleeping = true
+	meas.Site.PowerPV = 0
+	meas.Site.PowerGrid, meas.Site.HasGrid = 0, false
+	meas.Site.GridVoltages, meas.Site.GridFrequency = nil, 0
+	meas.Site.PowerLoad, meas.Site.HasLoad = 0, false
+	meas.Site.PowerBattery, meas.Site.HasBattery = 0, false
+	meas.Devices = make([]DeviceMeasurement, len(m.Devices))
+	for i, dev := range m.Devices {
+		if dev.Type == DeviceTypeInverter {
+			dev.Power = 0
+			dev.CurrentAC = 0
+			dev.CurrentDC = 0
+			if len(dev.DCInputs) > 0 {
+				dev.DCInputs = make([]DCInput, len(dev.DCInputs))
+				for j, input := range m.Devices[i].DCInputs {
+					input.Current, input.Power = 0, 0
+					dev.DCInputs[j] = input
+				}
+			}
+		}
+		meas.Devices[i] = dev
+	}
+	return &meas
+}
+
+// WithMeter takes the grid and load values from meas. A meter that is read separately keeps
+// measuring while the inverters sleep.
+func (m *Measurements) WithMeter(meas *Measurements) *Measurements {
+	m.Site.PowerGrid, m.Site.HasGrid = meas.Site.PowerGrid, meas.Site.HasGrid
+	m.Site.PowerLoad, m.Site.HasLoad = meas.Site.PowerLoad, meas.Site.HasLoad
+	m.Site.RelAutonomy, m.Site.RelSelfConsumption = meas.Site.RelAutonomy, meas.Site.RelSelfConsumption
+	m.Site.GridVoltages, m.Site.GridFrequency = meas.Site.GridVoltages, meas.Site.GridFrequency
+	return m
+}
+
+// SetInverterData sets the DC inputs and the AC values of the inverters from data by inverter id.
+// The DC voltage and current are those of the first input. Values that weren't read keep the ones
+// of the data source.
+func (m *Measurements) SetInverterData(data map[string]InverterData) {
+	for i := range m.Devices {
+		dev := &m.Devices[i]
+		if dev.Type != DeviceTypeInverter {
+			continue
+		}
+		d := data[dev.ID]
+		dev.DCInputs = d.DCInputs
+		if len(d.DCInputs) > 0 {
+			dev.VoltageDC, dev.CurrentDC = d.DCInputs[0].Voltage, d.DCInputs[0].Current
+		}
+		if d.Grid.Voltage > 0 || d.Grid.Frequency > 0 {
+			dev.VoltageAC, dev.CurrentAC, dev.Frequency = d.Grid.Voltage, d.Grid.Current, d.Grid.Frequency
+		}
+	}
+}
+
+// DevicesOfType returns all devices of the given type in the order the source reported them.
+func (m *Measurements) DevicesOfType(deviceType string) []DeviceMeasurement {
+	var devices []DeviceMeasurement
+	for _, dev := range m.Devices {
+		if dev.Type == deviceType {
+			devices = append(devices, dev)
+		}
+	}
+	return devices
+}
+
+func (m *Measurements) Device(deviceType, id string) *DeviceMeasurement {
+	for i := range m.Devices {
+		if m.Devices[i].Type == deviceType && m.Devices[i].ID == id {
+			return &m.Devices[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MinMax are the extremes an inverter logged in a period. Power is in W and voltages in V.
+type MinMax struct {
+	PowerMax     float64 `json:"p_max"`
+	VoltageACMax float64 `json:"u_ac_max"`
+	VoltageACMin float64 `json:"u_ac_min"`
+	VoltageDCMax float64 `json:"u_dc_max"`
+}
+
+// InverterMinMax is the latest MinMaxInverterData read from an inverter. Date is the local day
+// the values were read on and EnergyDay the production of that day at the time.
+type InverterMinMax struct {
+	Date      string    `json:"date"`
+	ReadAt    time.Time `json:"read_at"`
+	EnergyDay float64   `json:"e_day"`
+	Day       MinMax    `json:"day"`
+	Year      MinMax    `json:"year"`
+	Total     MinMax    `json:"total"`
+}
+
+// DailySummary sums up a day of the site. Site holds the highest and lowest values of all
+// inverters, PowerMax is the peak of the inverter producing the most.
+type DailySummary struct {
+	Date      string                    `json:"date"`
+	EnergyDay float64                   `json:"e_day"`
+	Site      MinMax                    `json:"site"`
+	Inverters map[string]InverterMinMax `json:"inverters"`
+}
+
+// DateLayout is the format of the local dates of min/max values and daily summaries.
+const DateLayout = "2006-01-02"
+
+// SetMinMax stores the min/max values read from an inverter.
+func (st *State) SetMinMax(id string, minMax InverterMinMax) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	st.device(deviceKey(DeviceTypeInverter, id)).MinMax = &minMax
+}
+
+// UpdateMinMaxEnergy keeps the production of the day stored with the min/max values of the
+// inverters up to date, until they go to sleep.
+func (st *State) UpdateMinMaxEnergy(measurements *Measurements) {
+	date := measurements.Timestamp.Local().Format(DateLayout)
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	for _, dev := range measurements.Devices {
+		if dev.Type != DeviceTypeInverter {
+			continue
+		}
+		if state, ok := st.Devices[deviceKey(DeviceTypeInverter, dev.ID)]; ok && state.MinMax != nil && state.MinMax.Date == date {
+			state.MinMax.EnergyDay = dev.EnergyDay
+		}
+	}
+}
+
+// MinMaxDates returns the dates of the stored min/max values, oldest first.
+func (st *State) MinMaxDates() []string {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	seen := make(map[string]bool)
+	var dates []string
+	for _, dev := range st.Devices {
+		if dev.MinMax != nil && !seen[dev.MinMax.Date] {
+			seen[dev.MinMax.Date] = true
+			dates = append(dates, dev.MinMax.Date)
+		}
+	}
+	sort.Strings(dates)
+	return dates
+}
+
+// DailySummary builds the summary of date from the min/max values read that day. It returns false
+// if no inverter was read on date.
+func (st *State) DailySummary(date string) (DailySummary, bool) {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	summary := DailySummary{Date: date, Inverters: make(map[string]InverterMinMax)}
+	for key, dev := range st.Devices {
+		if dev.MinMax == nil || dev.MinMax.Date != date {
+			continue
+		}
+		minMax := *dev.MinMax
+		summary.Inverters[strings.TrimPrefix(key, DeviceTypeInverter+":")] = minMax
+		summary.EnergyDay += minMax.EnergyDay
+		site := &summary.Site
+		site.PowerMax = math.Max(site.PowerMax, minMax.Day.PowerMax)
+		site.VoltageACMax = math.Max(site.VoltageACMax, minMax.Day.VoltageACMax)
+		site.VoltageDCMax = math.Max(site.VoltageDCMax, minMax.Day.VoltageDCMax)
+		if minMax.Day.VoltageACMin > 0 && (site.VoltageACMin == 0 || minMax.Day.VoltageACMin < site.VoltageACMin) {
+			site.VoltageACMin = minMax.Day.VoltageACMin
+		}
+	}
+	return summary, len(summary.Inverters) > 0
+}
+
+// SetLastSummary records the date of the last published daily summary.
+func (st *State) SetLastSummary(date string) {
+	st.mux.Lock()
+	st.LastSummary = date
+	st.mux.Unlock()
+}
+
+func (st *State) GetLastSummary() string {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	return st.LastSummary
+}
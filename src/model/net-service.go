@@ -6,8 +6,9 @@ import (
 	"github.com/futurehomeno/fimpgo/fimptype"
 )
 
-// SendInclusionReport sends inclusion report for one system
-func SendInclusionReport() fimptype.ThingInclusionReport {
+// SendInclusionReport sends inclusion report for one system, the self-consumption service is only
+// included if the site has a Smart Meter. dcInputs are the addresses of the DC inputs of the inverters.
+func SendInclusionReport(meter bool, dcInputs []string) fimptype.ThingInclusionReport {
 	var name, manufacturer string
 	var deviceAddr string
 	services := []fimptype.Service{}
@@ -44,6 +45,10 @@ func SendInclusionReport() fimptype.ThingInclusionReport {
 	serviceAddress := fmt.Sprintf("%s", systemID)
 	inverterService.Address = inverterService.Address + serviceAddress
 	services = append(services, inverterService)
+	if meter {
+		services = append(services, selfConsumptionService(systemID), houseLoadService(systemID))
+	}
+	services = append(services, dcInputServices(dcInputs)...)
 	deviceAddr = fmt.Sprintf("%s", systemID)
 	powerSource := "AC"
 
@@ -71,7 +76,7 @@ func SendInclusionReport() fimptype.ThingInclusionReport {
 	return inclReport
 }
 
-func SendHybridInclusionReport() fimptype.ThingInclusionReport {
+func SendHybridInclusionReport(dcInputs []string) fimptype.ThingInclusionReport {
 	var name, manufacturer string
 	var deviceAddr string
 	services := []fimptype.Service{}
@@ -179,7 +184,9 @@ func SendHybridInclusionReport() fimptype.ThingInclusionReport {
 	inverterSolarService.Address = inverterSolarService.Address + serviceAddress
 	batteryChargeService.Address = batteryChargeService.Address + serviceAddress
 	batteryService.Address = batteryService.Address + serviceAddress
-	services = append(services, inverterGridService, inverterSolarService, batteryChargeService, batteryService)
+	services = append(services, inverterGridService, inverterSolarService, batteryChargeService, batteryService, selfConsumptionService(systemID),
+		houseLoadService(systemID))
+	services = append(services, dcInputServices(dcInputs)...)
 	deviceAddr = fmt.Sprintf("%s", systemID)
 	powerSource := "AC"
 
@@ -206,3 +213,101 @@ func SendHybridInclusionReport() fimptype.ThingInclusionReport {
 
 	return inclReport
 }
+
+// SelfConsumptionService is the service of the site device reporting autonomy and self-consumption.
+const SelfConsumptionService = "self_consumption"
+
+// SelfConsumptionValues are the values of evt.self_consumption.report, in %. The rel_ values are the
+// current ones, the day_ values are computed from the energy statistics of the current day.
+var SelfConsumptionValues = []string{"rel_autonomy", "rel_self_consumption", "day_autonomy", "day_self_consumption"}
+
+// selfConsumptionService reports how self-sufficient the site is, right now and for the current day.
+func selfConsumptionService(systemID string) fimptype.Service {
+	return fimptype.Service{
+		Name:    SelfConsumptionService,
+		Alias:   "self_consumption",
+		Address: "/rt:dev/rn:fronius/ad:1/sv:" + SelfConsumptionService + "/ad:" + systemID,
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props: map[string]interface{}{
+			"sup_units":         []string{"%"},
+			"sup_extended_vals": SelfConsumptionValues,
+		},
+		Interfaces: []fimptype.Interface{{
+			Type:      "out",
+			MsgType:   "evt.self_consumption.report",
+			ValueType: "float_map",
+			Version:   "1",
+		}, {
+			Type:      "in",
+			MsgType:   "cmd.self_consumption.get_report",
+			ValueType: "null",
+			Version:   "1",
+		}},
+	}
+}
+
+// HouseLoadService is the service of the site device reporting the consumption of the house.
+const HouseLoadService = "meter_elec"
+
+// houseLoadService reports the load of the house, which Fronius derives from meter and production.
+func houseLoadService(systemID string) fimptype.Service {
+	return fimptype.Service{
+		Name:    HouseLoadService,
+		Alias:   "house_load",
+		Address: "/rt:dev/rn:fronius/ad:1/sv:" + HouseLoadService + "/ad:" + systemID,
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props: map[string]interface{}{
+			"sup_units":         []string{"W", "kWh"},
+			"sup_extended_vals": []string{"p_import", "e_import", "last_e_import"},
+		},
+		Interfaces: []fimptype.Interface{{
+			Type:      "out",
+			MsgType:   "evt.meter_ext.report",
+			ValueType: "float_map",
+			Version:   "1",
+		}, {
+			Type:      "in",
+			MsgType:   "cmd.meter_ext.get_report",
+			ValueType: "null",
+			Version:   "1",
+		}},
+	}
+}
+
+// DCInputAddress is the service address of a DC input, e.g. 1_2 for the second input of inverter 1.
+func DCInputAddress(inverterID string, index int) string {
+	return fmt.Sprintf("%s_%d", inverterID, index)
+}
+
+// dcInputServices are inverter_solar_conn services reporting the DC inputs (MPPT) of the inverters,
+// one per input, so a shaded or faulty string can be spotted.
+func dcInputServices(addresses []string) []fimptype.Service {
+	var services []fimptype.Service
+	for _, address := range addresses {
+		services = append(services, fimptype.Service{
+			Name:    "inverter_solar_conn",
+			Alias:   "dc_input_" + address,
+			Address: "/rt:dev/rn:fronius/ad:1/sv:inverter_solar_conn/ad:" + address,
+			Enabled: true,
+			Groups:  []string{"ch_0"},
+			Props: map[string]interface{}{
+				"sup_units":         []string{"W", "V", "A"},
+				"sup_extended_vals": []string{"dc_p", "dc_u", "dc_i"},
+			},
+			Interfaces: []fimptype.Interface{{
+				Type:      "out",
+				MsgType:   "evt.meter_ext.report",
+				ValueType: "float_map",
+				Version:   "1",
+			}, {
+				Type:      "in",
+				MsgType:   "cmd.meter_ext.get_report",
+				ValueType: "null",
+				Version:   "1",
+			}},
+		})
+	}
+	return services
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/utils"
+)
+
+// errCorrupt is returned when a state or config file can't be decoded.
+var errCorrupt = errors.New("corrupt file")
+
+// migration upgrades a decoded file from one schema version to the next.
+type migration func(doc map[string]interface{})
+
+// loadVersioned decodes the file at path into v. Files with an older schema version are migrated
+// first, the latest version is len(migrations). It returns true if the file was migrated.
+func loadVersioned(path string, migrations []migration, v interface{}) (bool, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return false, fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	version := 0
+	if v, ok := doc["schema_version"].(float64); ok {
+		version = int(v)
+	}
+	if version > len(migrations) {
+		log.Warnf("<model> %s has schema version %d, newer than %d supported by this version", filepath.Base(path), version, len(migrations))
+	}
+	migrated := version < len(migrations)
+	for ; version < len(migrations); version++ {
+		migrations[version](doc)
+		doc["schema_version"] = version + 1
+	}
+	if body, err = json.Marshal(doc); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return false, fmt.Errorf("%w: %v", errCorrupt, err)
+	}
+	return migrated, nil
+}
+
+// restoreDefaults moves a corrupt file aside and replaces it with the default file, so the app
+// can start. The corrupt file is kept with a .corrupt suffix for support.
+func restoreDefaults(path, defaultPath string, cause error) error {
+	log.Warnf("<model> %s can't be read, restoring defaults - %s", filepath.Base(path), cause)
+	if err := os.Rename(path, path+".corrupt"); err != nil {
+		log.Warn("<model> Can't keep corrupt file - ", err)
+	}
+	return utils.CopyFile(defaultPath, path)
+}
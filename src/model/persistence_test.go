@@ -0,0 +1,163 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thingsplex/fronius/utils"
+)
+
+func newWorkDir(t *testing.T) string {
+	workDir, err := ioutil.TempDir("", "fronius-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"data", "defaults"} {
+		os.MkdirAll(filepath.Join(workDir, dir), 0755)
+	}
+	for _, file := range []string{"config.json", "state.json"} {
+		if err := utils.CopyFile(filepath.Join("..", "..", "testdata", "defaults", file), filepath.Join(workDir, "defaults", file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return workDir
+}
+
+func TestStateMigration(t *testing.T) {
+	workDir := newWorkDir(t)
+	defer os.RemoveAll(workDir)
+	path := filepath.Join(workDir, "data", "state.json")
+	ioutil.WriteFile(path, []byte(`{"connected": true, "systems": {"Body": {}}, "configured_by": "auto"}`), 0664)
+
+	states := NewStates(workDir)
+	if err := states.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(body), `"schema_version":2`) || strings.Contains(string(body), "systems") {
+		t.Errorf("state not migrated: %s", body)
+	}
+}
+
+func TestStateMigrationPerDevice(t *testing.T) {
+	workDir := newWorkDir(t)
+	defer os.RemoveAll(workDir)
+	path := filepath.Join(workDir, "data", "state.json")
+	ioutil.WriteFile(path, []byte(`{"schema_version": 1, "PAC": "", "TOTAL_ENERGY": "",
+		"measurements": {"timestamp": "2026-05-01T12:00:00Z", "source": "solar_api", "site": {"p_pv": 1604, "e_total": 27280602},
+			"devices": [{"id": "1", "type": "inverter", "p": 1604}]},
+		"devices": [{"id": "1", "type": "inverter", "serial": "28136344"}, {"id": "0", "type": "meter", "serial": "19480123"}],
+		"counters": {"pv": {"total": 27280602}}}`), 0664)
+
+	states := NewStates(workDir)
+	if err := states.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	meas := states.LatestMeasurements()
+	if meas == nil || meas.Site.PowerPV != 1604 || len(meas.Devices) != 1 || meas.Devices[0].Power != 1604 {
+		t.Fatalf("measurements not migrated: %+v", meas)
+	}
+	devices := states.KnownDevices()
+	if len(devices) != 2 || devices[0].Serial != "28136344" || devices[1].Type != DeviceTypeMeter {
+		t.Errorf("devices not migrated: %+v", devices)
+	}
+	report := states.Report()
+	if report.Counters[CounterPV].Total != 27280602 || report.Devices["inverter:1"].Identity == nil {
+		t.Errorf("unexpected state %+v", report)
+	}
+	body, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(body), "TOTAL_ENERGY") || strings.Contains(string(body), `"measurements"`) {
+		t.Errorf("old fields kept: %s", body)
+	}
+}
+
+func TestCorruptStateRecovery(t *testing.T) {
+	workDir := newWorkDir(t)
+	defer os.RemoveAll(workDir)
+	path := filepath.Join(workDir, "data", "state.json")
+	ioutil.WriteFile(path, []byte(`{"measurements": {"site": {"p_pv": 12`), 0664)
+
+	states := NewStates(workDir)
+	if err := states.LoadFromFile(); err != nil {
+		t.Fatalf("corrupt state not recovered: %v", err)
+	}
+	if states.LatestMeasurements() != nil {
+		t.Error("measurements from corrupt file")
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Error("corrupt file not kept: ", err)
+	}
+}
+
+func TestConfigMigration(t *testing.T) {
+	workDir := newWorkDir(t)
+	defer os.RemoveAll(workDir)
+	path := filepath.Join(workDir, "data", "config.json")
+	ioutil.WriteFile(path, []byte(`{"host": "http://10.0.0.83/", "type": "not_hybrid", "poll_time_sec": 5}`), 0664)
+
+	configs := NewConfigs(workDir)
+	if err := configs.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if configs.Host != "10.0.0.83" || configs.SchemaVersion != ConfigSchemaVersion {
+		t.Errorf("config not migrated, host %q, version %d", configs.Host, configs.SchemaVersion)
+	}
+	if err := configs.ValidateInverter(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSaveCoalesced(t *testing.T) {
+	workDir := newWorkDir(t)
+	defer os.RemoveAll(workDir)
+	states := NewStates(workDir)
+	if err := states.SaveCoalesced(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(workDir, "data", "state.json")
+	first, _ := os.Stat(path)
+	states.SetMeasurements(NewMeasurements("test"))
+	time.Sleep(10 * time.Millisecond)
+	states.SaveCoalesced(time.Hour)
+	if second, _ := os.Stat(path); second.ModTime() != first.ModTime() {
+		t.Error("state written again within the interval")
+	}
+	entries, _ := ioutil.ReadDir(filepath.Join(workDir, "data"))
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp") {
+			t.Errorf("temp file %s left behind", entry.Name())
+		}
+	}
+}
+
+func TestDailySummaryPersisted(t *testing.T) {
+	workDir := newWorkDir(t)
+	defer os.RemoveAll(workDir)
+	states := NewStates(workDir)
+	states.SetMinMax("1", InverterMinMax{Date: "2026-06-20", EnergyDay: 30100, Day: MinMax{PowerMax: 7950, VoltageACMax: 246.1, VoltageACMin: 229.4, VoltageDCMax: 655}})
+	states.SetMinMax("2", InverterMinMax{Date: "2026-06-20", EnergyDay: 12400, Day: MinMax{PowerMax: 3300, VoltageACMax: 247.8, VoltageACMin: 227.9, VoltageDCMax: 512}})
+	states.SetLastSummary("2026-06-19")
+	if err := states.SaveToFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewStates(workDir)
+	if err := loaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetLastSummary() != "2026-06-19" {
+		t.Errorf("last summary %q not restored", loaded.GetLastSummary())
+	}
+	if _, ok := loaded.DailySummary("2026-06-21"); ok {
+		t.Error("summary of a day without min/max values")
+	}
+	summary, ok := loaded.DailySummary("2026-06-20")
+	want := MinMax{PowerMax: 7950, VoltageACMax: 247.8, VoltageACMin: 227.9, VoltageDCMax: 655}
+	if !ok || len(summary.Inverters) != 2 || summary.EnergyDay != 42500 || summary.Site != want {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
@@ -2,30 +2,125 @@ package model
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/futurehomeno/fimpgo/edgeapp"
-	"github.com/futurehomeno/fimpgo/utils"
 	log "github.com/sirupsen/logrus"
-	"github.com/thingsplex/fronius/fronius-api"
+	"github.com/thingsplex/fronius/utils"
 )
 
+// StateSchemaVersion is the version of state.json written by this version of the adapter.
+const StateSchemaVersion = 2
+
+// stateMigrations upgrade state.json, the migration at index i upgrades version i to i+1.
+var stateMigrations = []migration{
+	// 1: raw API responses were replaced by normalised measurements
+	func(doc map[string]interface{}) {
+		for _, key := range []string{"connected", "systems", "systemsh", "powerflow"} {
+			delete(doc, key)
+		}
+	},
+	// 2: measurements and device identities are kept per device
+	func(doc map[string]interface{}) {
+		for _, key := range []string{"PAC", "DAY_ENERGY", "YEAR_ENERGY", "TOTAL_ENERGY"} {
+			delete(doc, key)
+		}
+		devices := map[string]map[string]interface{}{}
+		entry := func(dev map[string]interface{}) map[string]interface{} {
+			key := deviceKey(fmt.Sprint(dev["type"]), fmt.Sprint(dev["id"]))
+			if devices[key] == nil {
+				devices[key] = map[string]interface{}{}
+			}
+			return devices[key]
+		}
+		identities, _ := doc["devices"].([]interface{})
+		for _, identity := range identities {
+			if dev, ok := identity.(map[string]interface{}); ok {
+				entry(dev)["identity"] = dev
+			}
+		}
+		if meas, ok := doc["measurements"].(map[string]interface{}); ok {
+			var order []interface{}
+			measured, _ := meas["devices"].([]interface{})
+			for _, measurement := range measured {
+				if dev, ok := measurement.(map[string]interface{}); ok {
+					e := entry(dev)
+					e["measurement"] = dev
+					e["measured_at"] = meas["timestamp"]
+					order = append(order, deviceKey(fmt.Sprint(dev["type"]), fmt.Sprint(dev["id"])))
+				}
+			}
+			doc["site"] = map[string]interface{}{"timestamp": meas["timestamp"], "source": meas["source"],
+				"sleeping": meas["sleeping"], "values": meas["site"], "devices": order}
+		}
+		delete(doc, "measurements")
+		doc["devices"] = devices
+	},
+}
+
+// State is what the adapter remembers between restarts: the last known measurements of the site
+// and of every device, the device identities, the energy counter baselines, the min/max values of
+// the inverters and when the poller last succeeded and is due to read energy and devices again.
 type State struct {
 	path          string
-	WorkDir       string               `json:"-"`
-	ConfiguredAt  string               `json:"configured_at"`
-	ConfiguredBy  string               `json:"configured_by"`
-	EnergyCurrent string               `json:"PAC"`
-	EnergyDay     string               `json:"DAY_ENERGY"`
-	EnergyYear    string               `json:"YEAR_ENERGY"`
-	EnergyTotal   string               `json:"TOTAL_ENERGY"`
-	Systems       fronius.System       `json:"systems"`
-	Systemsh      fronius.SystemHybrid `json:"systemsh"`
-	Powerflow     fronius.Powerflow    `json:"powerflow"`
+	mux           sync.RWMutex
+	savedAt       time.Time
+	SchemaVersion int                       `json:"schema_version"`
+	WorkDir       string                    `json:"-"`
+	ConfiguredAt  string                    `json:"configured_at"`
+	ConfiguredBy  string                    `json:"configured_by"`
+	Site          *SiteState                `json:"site"`
+	Devices       map[string]*DeviceState   `json:"devices"`
+	Counters      map[string]*EnergyCounter `json:"counters"`
+	LastSuccess   time.Time                 `json:"last_success"`
+	Schedule      Schedule                  `json:"schedule"`
+	LastSummary   string                    `json:"last_summary,omitempty"`
+}
+
+// SiteState is the site part of the last measurements. Devices are the keys of the devices
+// measured with it, in the order the source reported them.
+type SiteState struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Source    string           `json:"source"`
+	Sleeping  bool             `json:"sleeping"`
+	Values    SiteMeasurements `json:"values"`
+	Devices   []string         `json:"devices"`
+}
+
+// DeviceState is what is known about a device, its identity from the device list and its last
+// measurement. A device that isn't measured anymore keeps its last measurement.
+type DeviceState struct {
+	Identity    *DeviceIdentity    `json:"identity,omitempty"`
+	Measurement *DeviceMeasurement `json:"measurement,omitempty"`
+	MeasuredAt  time.Time          `json:"measured_at"`
+	MinMax      *InverterMinMax    `json:"min_max,omitempty"`
+}
+
+// Schedule is the poller state that outlives a restart, so energy counters and the device list
+// aren't read again before they are due.
+type Schedule struct {
+	EnergyUpdatedAt time.Time `json:"energy_updated_at"`
+	DevicesReadAt   time.Time `json:"devices_read_at"`
+	MinMaxReadAt    time.Time `json:"min_max_read_at"`
+}
+
+// StateReport is a copy of the state, as reported over FIMP.
+type StateReport struct {
+	Site        *SiteState               `json:"site"`
+	Devices     map[string]DeviceState   `json:"devices"`
+	Counters    map[string]EnergyCounter `json:"counters"`
+	LastSuccess time.Time                `json:"last_success"`
+	Schedule    Schedule                 `json:"schedule"`
+	LastSummary string                   `json:"last_summary,omitempty"`
+}
+
+func deviceKey(deviceType, id string) string {
+	return deviceType + ":" + id
 }
 
 func NewStates(workDir string) *State {
@@ -48,27 +143,242 @@ func (st *State) InitFiles() error {
 	return nil
 }
 
+// LoadFromFile loads and if needed migrates state.json. A corrupt file is replaced by the default state.
 func (st *State) LoadFromFile() error {
-	stateFileBody, err := ioutil.ReadFile(st.path)
-	if err != nil {
-		return err
+	migrated, err := loadVersioned(st.path, stateMigrations, st)
+	if errors.Is(err, errCorrupt) {
+		if err := restoreDefaults(st.path, filepath.Join(st.WorkDir, "defaults", "state.json"), err); err != nil {
+			return err
+		}
+		migrated, err = loadVersioned(st.path, stateMigrations, st)
 	}
-	err = json.Unmarshal(stateFileBody, st)
 	if err != nil {
 		return err
 	}
+	if migrated {
+		log.Info("<model> State migrated to schema version ", StateSchemaVersion)
+		return st.SaveToFile()
+	}
 	return nil
 }
 
+// SaveToFile writes state.json right away.
 func (st *State) SaveToFile() error {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	st.SchemaVersion = StateSchemaVersion
 	st.ConfiguredBy = "auto"
 	st.ConfiguredAt = time.Now().Format(time.RFC3339)
 	bpayload, err := json.Marshal(st)
-	err = ioutil.WriteFile(st.path, bpayload, 0664)
 	if err != nil {
 		return err
 	}
-	return err
+	if err := utils.WriteFileAtomic(st.path, bpayload, 0664); err != nil {
+		return err
+	}
+	st.savedAt = time.Now()
+	return nil
+}
+
+// SaveCoalesced writes state.json at most once per interval to spare the flash storage. Changes
+// in between are written by a later call or by SaveToFile.
+func (st *State) SaveCoalesced(interval time.Duration) error {
+	st.mux.RLock()
+	due := time.Since(st.savedAt) >= interval
+	st.mux.RUnlock()
+	if !due {
+		return nil
+	}
+	return st.SaveToFile()
+}
+
+// SetMeasurements records the measurements of the site and of its devices.
+func (st *State) SetMeasurements(measurements *Measurements) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	site := &SiteState{Timestamp: measurements.Timestamp, Source: measurements.Source, Sleeping: measurements.Sleeping,
+		Values: measurements.Site}
+	for _, dev := range measurements.Devices {
+		dev := dev
+		key := deviceKey(dev.Type, dev.ID)
+		site.Devices = append(site.Devices, key)
+		device := st.device(key)
+		device.Measurement = &dev
+		device.MeasuredAt = measurements.Timestamp
+	}
+	st.Site = site
+}
+
+// LatestMeasurements returns the last measurements, or nil if nothing was measured yet.
+func (st *State) LatestMeasurements() *Measurements {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	if st.Site == nil {
+		return nil
+	}
+	meas := &Measurements{Timestamp: st.Site.Timestamp, Source: st.Site.Source, Sleeping: st.Site.Sleeping, Site: st.Site.Values}
+	for _, key := range st.Site.Devices {
+		if dev, ok := st.Devices[key]; ok && dev.Measurement != nil {
+			meas.Devices = append(meas.Devices, *dev.Measurement)
+		}
+	}
+	return meas
+}
+
+// UpdateEnergyCounter feeds a lifetime counter reading into the named counter and returns the accepted delta in Wh.
+func (st *State) UpdateEnergyCounter(name string, total float64, at time.Time, maxPowerW float64) (float64, error) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	return st.counter(name).Update(total, at, maxPowerW)
+}
+
+// IntegrateEnergyCounter feeds a power sample into the named counter and returns the counted delta in Wh.
+func (st *State) IntegrateEnergyCounter(name string, powerW float64, at time.Time) float64 {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	return st.counter(name).Integrate(powerW, at)
+}
+
+// counter returns the named counter, created if it doesn't exist yet. The caller must hold the lock.
+func (st *State) counter(name string) *EnergyCounter {
+	if st.Counters == nil {
+		st.Counters = make(map[string]*EnergyCounter)
+	}
+	counter, ok := st.Counters[name]
+	if !ok {
+		counter = &EnergyCounter{}
+		st.Counters[name] = counter
+	}
+	return counter
+}
+
+// EnergyCounter returns a copy of the named counter.
+func (st *State) EnergyCounter(name string) EnergyCounter {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	if counter, ok := st.Counters[name]; ok {
+		return *counter
+	}
+	return EnergyCounter{}
+}
+
+// MarkEnergyReported records that the named counter was reported up to total.
+func (st *State) MarkEnergyReported(name string, total float64) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	if counter, ok := st.Counters[name]; ok && total > counter.Reported {
+		counter.Reported = total
+	}
+}
+
+// SetDevices replaces the identities of the devices of the site.
+func (st *State) SetDevices(devices []DeviceIdentity) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	for _, dev := range st.Devices {
+		dev.Identity = nil
+	}
+	for _, identity := range devices {
+		identity := identity
+		st.device(deviceKey(identity.Type, identity.ID)).Identity = &identity
+	}
+}
+
+// KnownDevices returns the identities of the devices of the site, sorted by type and id.
+func (st *State) KnownDevices() []DeviceIdentity {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	var devices []DeviceIdentity
+	for _, dev := range st.Devices {
+		if dev.Identity != nil {
+			devices = append(devices, *dev.Identity)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Type != devices[j].Type {
+			return devices[i].Type < devices[j].Type
+		}
+		return devices[i].ID < devices[j].ID
+	})
+	return devices
+}
+
+// device returns the entry of a device, created if it's not known yet. The caller must hold the lock.
+func (st *State) device(key string) *DeviceState {
+	if st.Devices == nil {
+		st.Devices = make(map[string]*DeviceState)
+	}
+	dev, ok := st.Devices[key]
+	if !ok {
+		dev = &DeviceState{}
+		st.Devices[key] = dev
+	}
+	return dev
+}
+
+// SetLastSuccess records the time of the last successful poll.
+func (st *State) SetLastSuccess(at time.Time) {
+	st.mux.Lock()
+	st.LastSuccess = at
+	st.mux.Unlock()
+}
+
+func (st *State) GetLastSuccess() time.Time {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	return st.LastSuccess
+}
+
+func (st *State) SetSchedule(schedule Schedule) {
+	st.mux.Lock()
+	st.Schedule = schedule
+	st.mux.Unlock()
+}
+
+func (st *State) GetSchedule() Schedule {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	return st.Schedule
+}
+
+// ResetSite forgets measurements, energy counters, devices, the schedule and the last summary, when they belong to
+// another site after reconfiguration.
+func (st *State) ResetSite() {
+	st.mux.Lock()
+	st.Site = nil
+	st.Devices = nil
+	st.Counters = nil
+	st.Schedule = Schedule{}
+	st.LastSummary = ""
+	st.mux.Unlock()
+}
+
+// ResetCounters forgets the energy counters and the schedule, when another Datamanager is
+// configured for the same site. The counters start over from its first reading.
+func (st *State) ResetCounters() {
+	st.mux.Lock()
+	st.Counters = nil
+	st.Schedule = Schedule{}
+	st.mux.Unlock()
+}
+
+// Report returns a copy of the state.
+func (st *State) Report() StateReport {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	report := StateReport{LastSuccess: st.LastSuccess, Schedule: st.Schedule, LastSummary: st.LastSummary,
+		Devices: make(map[string]DeviceState, len(st.Devices)), Counters: make(map[string]EnergyCounter, len(st.Counters))}
+	if st.Site != nil {
+		site := *st.Site
+		report.Site = &site
+	}
+	for key, dev := range st.Devices {
+		report.Devices[key] = *dev
+	}
+	for name, counter := range st.Counters {
+		report.Counters[name] = *counter
+	}
+	return report
 }
 
 func (st *State) GetDataDir() string {
@@ -86,21 +396,3 @@ func (st *State) LoadDefaults() error {
 	defaultConfigFile := filepath.Join(st.WorkDir, "defaults", "config.json")
 	return utils.CopyFile(defaultConfigFile, stateFile)
 }
-
-func (st *State) IsConfigured() bool {
-	if st.Systems.Body.Data.EnergyTotal.Value.Value != 0 {
-		return true
-	} else {
-		return false
-	}
-}
-
-type PublicStates struct {
-	ConnectionState string `json:"connection_state"`
-	Errors          string `json:"errors"`
-}
-
-type StateReport struct {
-	OpStatus string            `json:"op_status"`
-	AppState edgeapp.AppStates `json:"app_state"`
-}
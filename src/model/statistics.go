@@ -0,0 +1,341 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/utils"
+)
+
+// StatisticsSchemaVersion is the version of statistics.json written by this version of the adapter.
+const StatisticsSchemaVersion = 1
+
+var statisticsMigrations = []migration{
+	// 1: first version
+	func(doc map[string]interface{}) {},
+}
+
+// Aggregation periods of the statistics
+const (
+	PeriodHour  = "hour"
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// How many periods are kept, older ones are dropped.
+const (
+	keepHours  = 24 * 31
+	keepDays   = 366 * 2
+	keepMonths = 12 * 10
+)
+
+// maxSampleGap is the longest time between two measurements that power is integrated over. After
+// a longer gap, e.g. while the inverter couldn't be reached, the energy flows aren't known.
+const maxSampleGap = 10 * time.Minute
+
+// EnergyTotals are the energy flows of the site in a period, in Wh. Production is taken from the
+// lifetime counter of the inverters, the other flows are integrated from the power values.
+// Metered is set when grid power was measured in the period.
+type EnergyTotals struct {
+	Production       float64 `json:"production_wh"`
+	Consumption      float64 `json:"consumption_wh"`
+	GridImport       float64 `json:"grid_import_wh"`
+	GridExport       float64 `json:"grid_export_wh"`
+	BatteryCharge    float64 `json:"battery_charge_wh"`
+	BatteryDischarge float64 `json:"battery_discharge_wh"`
+	Metered          bool    `json:"metered"`
+}
+
+func (t *EnergyTotals) add(o EnergyTotals) {
+	t.Production += o.Production
+	t.Consumption += o.Consumption
+	t.GridImport += o.GridImport
+	t.GridExport += o.GridExport
+	t.BatteryCharge += o.BatteryCharge
+	t.BatteryDischarge += o.BatteryDischarge
+	t.Metered = t.Metered || o.Metered
+}
+
+// SelfConsumption returns the produced energy used on site, including battery charging. It's
+// only known with a meter.
+func (t EnergyTotals) SelfConsumption() (float64, bool) {
+	if !t.Metered {
+		return 0, false
+	}
+	return math.Max(t.Production-t.GridExport, 0), true
+}
+
+// Autonomy returns the share of the consumption not imported from the grid, in %.
+func (t EnergyTotals) Autonomy() (float64, bool) {
+	if !t.Metered || t.Consumption <= 0 {
+		return 0, false
+	}
+	return clampPercent(100 * (1 - t.GridImport/t.Consumption)), true
+}
+
+// SelfConsumptionRate returns the share of the production used on site, in %.
+func (t EnergyTotals) SelfConsumptionRate() (float64, bool) {
+	selfConsumption, ok := t.SelfConsumption()
+	if !ok || t.Production <= 0 {
+		return 0, false
+	}
+	return clampPercent(100 * selfConsumption / t.Production), true
+}
+
+func clampPercent(v float64) float64 {
+	return math.Round(math.Min(math.Max(v, 0), 100)*10) / 10
+}
+
+// EnergyBucket are the totals of the period starting at Start, in local time.
+type EnergyBucket struct {
+	Start time.Time `json:"start"`
+	EnergyTotals
+}
+
+// EnergyPeriod is a period as reported, with the derived values if they are known.
+type EnergyPeriod struct {
+	Start time.Time `json:"start"`
+	EnergyTotals
+	SelfConsumption     *float64 `json:"self_consumption_wh,omitempty"`
+	Autonomy            *float64 `json:"autonomy,omitempty"`
+	SelfConsumptionRate *float64 `json:"self_consumption_rate,omitempty"`
+}
+
+func NewEnergyPeriod(start time.Time, totals EnergyTotals) EnergyPeriod {
+	p := EnergyPeriod{Start: start, EnergyTotals: totals}
+	if v, ok := totals.SelfConsumption(); ok {
+		p.SelfConsumption = &v
+	}
+	if v, ok := totals.Autonomy(); ok {
+		p.Autonomy = &v
+	}
+	if v, ok := totals.SelfConsumptionRate(); ok {
+		p.SelfConsumptionRate = &v
+	}
+	return p
+}
+
+// StatisticsReport answers a query for a range of periods.
+type StatisticsReport struct {
+	Period  string         `json:"period"`
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	Total   EnergyPeriod   `json:"total"`
+	Periods []EnergyPeriod `json:"periods"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// powerSample are the power values of a measurement, signed like Fronius reports them.
+type powerSample struct {
+	at          time.Time
+	pv          float64
+	grid        float64
+	battery     float64
+	consumption float64
+	hasGrid     bool
+	hasBattery  bool
+}
+
+// Statistics aggregates the energy flows of the site by hour, day and month and keeps them in
+// data/statistics.json. It receives every published measurement from the poller, and the meter
+// values read while the inverters sleep.
+type Statistics struct {
+	path          string
+	configs       *Configs
+	mux           sync.Mutex
+	savedAt       time.Time
+	last          *powerSample
+	SchemaVersion int             `json:"schema_version"`
+	Counter       EnergyCounter   `json:"counter"`
+	Hourly        []*EnergyBucket `json:"hourly"`
+	Daily         []*EnergyBucket `json:"daily"`
+	Monthly       []*EnergyBucket `json:"monthly"`
+}
+
+func NewStatistics(configs *Configs) *Statistics {
+	return &Statistics{configs: configs, path: filepath.Join(configs.GetDataDir(), "statistics.json")}
+}
+
+// LoadFromFile loads statistics.json if it exists. A corrupt file is moved aside and the statistics start over.
+func (s *Statistics) LoadFromFile() error {
+	if !utils.FileExists(s.path) {
+		return nil
+	}
+	_, err := loadVersioned(s.path, statisticsMigrations, s)
+	if errors.Is(err, errCorrupt) {
+		log.Warn("<model> statistics.json can't be read, starting over - ", err)
+		if err := os.Rename(s.path, s.path+".corrupt"); err != nil {
+			log.Warn("<model> Can't keep corrupt file - ", err)
+		}
+		return nil
+	}
+	return err
+}
+
+// SaveToFile writes statistics.json right away.
+func (s *Statistics) SaveToFile() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.save()
+}
+
+func (s *Statistics) save() error {
+	s.SchemaVersion = StatisticsSchemaVersion
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(s.path, body, 0664); err != nil {
+		return err
+	}
+	s.savedAt = time.Now()
+	return nil
+}
+
+// Add adds the energy since the previous measurement. statistics.json is written at most once
+// per state save interval.
+func (s *Statistics) Add(meas *Measurements) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sample := newPowerSample(meas)
+	var totals EnergyTotals
+	if s.last != nil {
+		totals = s.integrate(*s.last, sample)
+	}
+	delta, err := s.Counter.Update(meas.Site.EnergyTotal, meas.Timestamp, s.configs.MaxSitePower())
+	if err != nil {
+		log.Debug("<model> Statistics: ", err)
+	}
+	totals.Production = delta
+	s.last = &sample
+	s.addTotals(meas.Timestamp, totals)
+
+	if time.Since(s.savedAt) >= s.configs.StateSaveInterval() {
+		if err := s.save(); err != nil {
+			log.Error("<model> Can't save statistics. Error: ", err)
+		}
+	}
+}
+
+func newPowerSample(meas *Measurements) powerSample {
+	site := meas.Site
+	sample := powerSample{at: meas.Timestamp, pv: site.PowerPV, grid: site.PowerGrid, battery: site.PowerBattery,
+		hasGrid: site.HasGrid, hasBattery: site.HasBattery}
+	switch {
+	case site.HasLoad:
+		sample.consumption = math.Abs(site.PowerLoad)
+	case site.HasGrid:
+		// the power balance of the site, Fronius reports import and discharging as positive
+		sample.consumption = math.Max(site.PowerPV+site.PowerGrid+site.PowerBattery, 0)
+	}
+	return sample
+}
+
+// integrate returns the energy flows between two samples, with the power of the earlier one.
+func (s *Statistics) integrate(from, to powerSample) EnergyTotals {
+	var totals EnergyTotals
+	gap := to.at.Sub(from.at)
+	if gap <= 0 || gap > maxSampleGap {
+		return totals
+	}
+	hours := gap.Hours()
+	if from.hasGrid && to.hasGrid {
+		totals.Metered = true
+		totals.GridImport = math.Max(from.grid, 0) * hours
+		totals.GridExport = math.Max(-from.grid, 0) * hours
+		totals.Consumption = from.consumption * hours
+	}
+	if from.hasBattery && to.hasBattery {
+		totals.BatteryCharge = math.Max(-from.battery, 0) * hours
+		totals.BatteryDischarge = math.Max(from.battery, 0) * hours
+	}
+	return totals
+}
+
+func (s *Statistics) addTotals(at time.Time, totals EnergyTotals) {
+	at = at.In(time.Local)
+	s.Hourly = addToBucket(s.Hourly, periodStart(PeriodHour, at), totals, keepHours)
+	s.Daily = addToBucket(s.Daily, periodStart(PeriodDay, at), totals, keepDays)
+	s.Monthly = addToBucket(s.Monthly, periodStart(PeriodMonth, at), totals, keepMonths)
+}
+
+// addToBucket adds totals to the last bucket or starts a new one, buckets are sorted by start.
+func addToBucket(buckets []*EnergyBucket, start time.Time, totals EnergyTotals, keep int) []*EnergyBucket {
+	if n := len(buckets); n > 0 && buckets[n-1].Start.Equal(start) {
+		buckets[n-1].add(totals)
+		return buckets
+	}
+	buckets = append(buckets, &EnergyBucket{Start: start, EnergyTotals: totals})
+	if len(buckets) > keep {
+		buckets = append([]*EnergyBucket(nil), buckets[len(buckets)-keep:]...)
+	}
+	return buckets
+}
+
+// periodStart returns the start of the period at is in, in the time zone of at.
+func periodStart(period string, at time.Time) time.Time {
+	y, m, d := at.Date()
+	switch period {
+	case PeriodHour:
+		return time.Date(y, m, d, at.Hour(), 0, 0, 0, at.Location())
+	case PeriodDay:
+		return time.Date(y, m, d, 0, 0, 0, 0, at.Location())
+	}
+	return time.Date(y, m, 1, 0, 0, 0, 0, at.Location())
+}
+
+// Query returns the periods starting from from until before to. Periods without measurements are left out.
+func (s *Statistics) Query(period string, from, to time.Time) (StatisticsReport, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var buckets []*EnergyBucket
+	switch period {
+	case PeriodHour:
+		buckets = s.Hourly
+	case PeriodDay:
+		buckets = s.Daily
+	case PeriodMonth:
+		buckets = s.Monthly
+	default:
+		return StatisticsReport{}, fmt.Errorf("unknown period %q, expected hour, day or month", period)
+	}
+	report := StatisticsReport{Period: period, From: from, To: to, Periods: []EnergyPeriod{}}
+	var total EnergyTotals
+	for _, bucket := range buckets {
+		if !bucket.Start.Before(from) && bucket.Start.Before(to) {
+			report.Periods = append(report.Periods, NewEnergyPeriod(bucket.Start, bucket.EnergyTotals))
+			total.add(bucket.EnergyTotals)
+		}
+	}
+	report.Total = NewEnergyPeriod(from, total)
+	return report, nil
+}
+
+// Current returns the totals of the period that is in progress.
+func (s *Statistics) Current(period string) EnergyTotals {
+	report, err := s.Query(period, periodStart(period, time.Now()), time.Now().Add(time.Second))
+	if err != nil {
+		return EnergyTotals{}
+	}
+	return report.Total.EnergyTotals
+}
+
+// DefaultRange returns the range queried when none is given: today by hour, this month by day
+// or this year by month.
+func DefaultRange(period string, now time.Time) (from time.Time, to time.Time) {
+	y, m, d := now.Date()
+	switch period {
+	case PeriodHour:
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location()), now
+	case PeriodDay:
+		return time.Date(y, m, 1, 0, 0, 0, 0, now.Location()), now
+	}
+	return time.Date(y, 1, 1, 0, 0, 0, 0, now.Location()), now
+}
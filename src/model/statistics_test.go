@@ -0,0 +1,83 @@
+package model
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStatisticsAggregation(t *testing.T) {
+	workDir := newWorkDir(t)
+	defer os.RemoveAll(workDir)
+	stats := NewStatistics(&Configs{WorkDir: workDir})
+
+	start := time.Date(2026, 6, 30, 23, 0, 0, 0, time.Local)
+	// 2 kW PV, 500 W exported and 1 kW charged into the battery, for 90 minutes in 5 minute steps
+	for i := 0; i <= 18; i++ {
+		meas := &Measurements{Timestamp: start.Add(time.Duration(i) * 5 * time.Minute)}
+		meas.Site = SiteMeasurements{PowerPV: 2000, PowerGrid: -500, PowerBattery: -1000, PowerLoad: -500,
+			HasGrid: true, HasLoad: true, HasBattery: true, EnergyTotal: 1000000 + float64(i)*2000/12}
+		stats.Add(meas)
+	}
+
+	report, err := stats.Query(PeriodHour, start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Periods) != 2 {
+		t.Fatalf("expected 2 hours, got %+v", report.Periods)
+	}
+	// the energy between two measurements counts in the period of the later one
+	first := report.Periods[0]
+	if !almost(first.Production, 2000*11/12.0) || !almost(first.GridExport, 500*11/12.0) || !almost(first.BatteryCharge, 1000*11/12.0) ||
+		!almost(first.Consumption, 500*11/12.0) {
+		t.Errorf("unexpected first hour %+v", first.EnergyTotals)
+	}
+	total := report.Total
+	if !almost(total.Production, 3000) || !almost(total.GridExport, 750) || total.GridImport != 0 {
+		t.Errorf("unexpected total %+v", total.EnergyTotals)
+	}
+	if total.Autonomy == nil || *total.Autonomy != 100 || total.SelfConsumptionRate == nil || *total.SelfConsumptionRate != 75 {
+		t.Errorf("unexpected ratios %v %v", total.Autonomy, total.SelfConsumptionRate)
+	}
+
+	months, _ := stats.Query(PeriodMonth, time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local), time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local))
+	if len(months.Periods) != 2 || months.Periods[1].Start.Month() != time.July {
+		t.Errorf("unexpected months %+v", months.Periods)
+	}
+	if _, err := stats.Query("week", start, start); err == nil {
+		t.Error("unknown period accepted")
+	}
+
+	if err := stats.SaveToFile(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewStatistics(&Configs{WorkDir: workDir})
+	if err := loaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if days, _ := loaded.Query(PeriodDay, start.Add(-23*time.Hour), start.Add(2*time.Hour)); len(days.Periods) != 2 || !almost(days.Total.Production, 3000) {
+		t.Errorf("statistics not persisted %+v", days)
+	}
+}
+
+func TestStatisticsWithoutMeter(t *testing.T) {
+	workDir := newWorkDir(t)
+	defer os.RemoveAll(workDir)
+	stats := NewStatistics(&Configs{WorkDir: workDir})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		meas := &Measurements{Timestamp: now.Add(time.Duration(i) * time.Minute)}
+		meas.Site = SiteMeasurements{PowerPV: 1200, EnergyTotal: 5000 + float64(i)*20}
+		stats.Add(meas)
+	}
+	current := stats.Current(PeriodDay)
+	period := NewEnergyPeriod(now, current)
+	if current.Metered || period.Autonomy != nil || period.SelfConsumption != nil || !almost(current.Production, 40) {
+		t.Errorf("unexpected totals without meter %+v", period)
+	}
+}
+
+func almost(a, b float64) bool {
+	return a-b < 0.001 && b-a < 0.001
+}
@@ -0,0 +1,296 @@
+package restapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/handler"
+	"github.com/thingsplex/fronius/model"
+)
+
+const actionsPath = "/api/v1/actions/"
+
+// SiteStatus is implemented by handler.Poller.
+type SiteStatus interface {
+	Health() handler.Health
+}
+
+// ActionRunner is implemented by handler.FromFimpRouter.
+type ActionRunner interface {
+	RunSystemAction(name string) error
+}
+
+// ConfigSource is implemented by handler.FromFimpRouter, which changes the configs at runtime.
+type ConfigSource interface {
+	ConfigSnapshot() model.Configs
+}
+
+// Server is the local REST API. Read endpoints answer from the state the FIMP reports are built
+// from, the action endpoints run the same actions as the cmd.system.* commands and need the
+// configured token.
+type Server struct {
+	configs *model.Configs
+	state   *model.State
+	status  SiteStatus
+	actions ActionRunner
+	source  ConfigSource
+	server  *http.Server
+}
+
+// SiteSummary is the answer to GET /api/v1/site.
+type SiteSummary struct {
+	Type        string                  `json:"type"`
+	Connected   bool                    `json:"connected"`
+	LastSuccess time.Time               `json:"last_success"`
+	LastError   string                  `json:"last_error,omitempty"`
+	Timestamp   time.Time               `json:"timestamp"`
+	Sleeping    bool                    `json:"sleeping"`
+	Site        *model.SiteMeasurements `json:"site"`
+	Devices     int                     `json:"devices"`
+}
+
+// Device is an entry of GET /api/v1/devices.
+type Device struct {
+	ID          string                   `json:"id"`
+	Type        string                   `json:"type"`
+	Identity    *model.DeviceIdentity    `json:"identity,omitempty"`
+	Measurement *model.DeviceMeasurement `json:"measurement,omitempty"`
+	MeasuredAt  time.Time                `json:"measured_at"`
+}
+
+// ConfigView is the answer to GET /api/v1/config. It only has settings that are safe to show
+// without a token, new config fields aren't listed until they are added here.
+type ConfigView struct {
+	Host                  string                    `json:"host"`
+	Type                  string                    `json:"type"`
+	LogLevel              string                    `json:"log_level"`
+	PollTimeSec           int                       `json:"poll_time_sec"`
+	EnergyPollTimeSec     int                       `json:"energy_poll_time_sec"`
+	DeviceInfoPollTimeSec int                       `json:"device_info_poll_time_sec"`
+	MinMaxPollTimeSec     int                       `json:"min_max_poll_time_sec"`
+	NightPollTimeSec      int                       `json:"night_poll_time_sec"`
+	MaxSitePowerW         float64                   `json:"max_site_power_w"`
+	CaptureEnabled        bool                      `json:"capture_enabled"`
+	ReportHeartbeatSec    int                       `json:"report_heartbeat_sec"`
+	OfflineAfterFailures  int                       `json:"offline_after_failures"`
+	RequestTimeoutSec     int                       `json:"request_timeout_sec"`
+	MaxBackoffSec         int                       `json:"max_backoff_sec"`
+	StateSaveIntervalSec  int                       `json:"state_save_interval_sec"`
+	MetricsEnabled        bool                      `json:"metrics_enabled"`
+	MetricsAddress        string                    `json:"metrics_address"`
+	APIEnabled            bool                      `json:"api_enabled"`
+	APIAddress            string                    `json:"api_address"`
+	HomeAssistantEnabled  bool                      `json:"ha_discovery_enabled"`
+	HomeAssistantPrefix   string                    `json:"ha_discovery_prefix"`
+	InfluxEnabled         bool                      `json:"influx_enabled"`
+	GridQuality           model.GridQualityConfig   `json:"grid_quality"`
+	ReportDeadband        model.Deadband            `json:"report_deadband"`
+	ReportDeadbands       map[string]model.Deadband `json:"report_deadbands"`
+}
+
+// ActionResult is the answer to POST /api/v1/actions/<name>.
+type ActionResult struct {
+	Action string `json:"action"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func NewServer(configs *model.Configs, state *model.State, status SiteStatus, actions ActionRunner, source ConfigSource) *Server {
+	return &Server{configs: configs, state: state, status: status, actions: actions, source: source}
+}
+
+// Start listens on the configured address and serves the API in the background.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.configs.APIListenAddress())
+	if err != nil {
+		return err
+	}
+	s.server = &http.Server{Handler: s.Handler(), ReadTimeout: 10 * time.Second, WriteTimeout: 60 * time.Second}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error("<api> Server stopped. Error: ", err)
+		}
+	}()
+	if s.configs.APIToken == "" {
+		log.Warn("<api> No api_token configured, actions are disabled")
+	}
+	log.Info("<api> Serving REST API on ", listener.Addr())
+	return nil
+}
+
+// Stop waits for requests in progress to complete.
+func (s *Server) Stop() {
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Warn("<api> Can't stop server. Error: ", err)
+	}
+}
+
+// Handler returns the routes of the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/site", s.get(s.site))
+	mux.HandleFunc("/api/v1/devices", s.get(s.devices))
+	mux.HandleFunc("/api/v1/live", s.get(s.live))
+	mux.HandleFunc("/api/v1/energy", s.get(s.energy))
+	mux.HandleFunc("/api/v1/config", s.get(s.config))
+	mux.HandleFunc(actionsPath, s.action)
+	return mux
+}
+
+// get wraps a read endpoint, read returns the value to answer with or nil if there is none yet.
+func (s *Server) get(read func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		val := read()
+		if val == nil {
+			writeError(w, http.StatusServiceUnavailable, "nothing measured yet")
+			return
+		}
+		writeJSON(w, http.StatusOK, val)
+	}
+}
+
+func (s *Server) site() interface{} {
+	health := s.status.Health()
+	summary := SiteSummary{Type: s.source.ConfigSnapshot().Type, Connected: health.Connected, LastSuccess: s.state.GetLastSuccess(),
+		LastError: health.LastError, Devices: len(s.state.KnownDevices())}
+	if meas := s.state.LatestMeasurements(); meas != nil {
+		summary.Timestamp, summary.Sleeping, summary.Site = meas.Timestamp, meas.Sleeping, &meas.Site
+	}
+	return summary
+}
+
+// devices lists the devices of the site, the listed ones first, then the ones that were only measured.
+func (s *Server) devices() interface{} {
+	report := s.state.Report()
+	devices := []Device{}
+	listed := make(map[string]bool)
+	for _, identity := range s.state.KnownDevices() {
+		identity := identity
+		key := identity.Type + ":" + identity.ID
+		listed[key] = true
+		dev := report.Devices[key]
+		devices = append(devices, Device{ID: identity.ID, Type: identity.Type, Identity: &identity, Measurement: dev.Measurement, MeasuredAt: dev.MeasuredAt})
+	}
+	if meas := s.state.LatestMeasurements(); meas != nil {
+		for _, m := range meas.Devices {
+			if key := m.Type + ":" + m.ID; !listed[key] {
+				dev := report.Devices[key]
+				devices = append(devices, Device{ID: m.ID, Type: m.Type, Measurement: dev.Measurement, MeasuredAt: dev.MeasuredAt})
+			}
+		}
+	}
+	return devices
+}
+
+func (s *Server) live() interface{} {
+	if meas := s.state.LatestMeasurements(); meas != nil {
+		return meas
+	}
+	return nil
+}
+
+func (s *Server) energy() interface{} {
+	return s.state.Report().Counters
+}
+
+// config returns the settings of ConfigView, never credentials.
+func (s *Server) config() interface{} {
+	conf := s.source.ConfigSnapshot()
+	return ConfigView{
+		Host:                  conf.Host,
+		Type:                  conf.Type,
+		LogLevel:              conf.LogLevel,
+		PollTimeSec:           conf.PollTimeSec,
+		EnergyPollTimeSec:     conf.EnergyPollTimeSec,
+		DeviceInfoPollTimeSec: conf.DeviceInfoPollTimeSec,
+		MinMaxPollTimeSec:     conf.MinMaxPollTimeSec,
+		NightPollTimeSec:      conf.NightPollTimeSec,
+		MaxSitePowerW:         conf.MaxSitePowerW,
+		CaptureEnabled:        conf.CaptureEnabled,
+		ReportHeartbeatSec:    conf.ReportHeartbeatSec,
+		OfflineAfterFailures:  conf.OfflineAfterFailures,
+		RequestTimeoutSec:     conf.RequestTimeoutSec,
+		MaxBackoffSec:         conf.MaxBackoffSec,
+		StateSaveIntervalSec:  conf.StateSaveIntervalSec,
+		MetricsEnabled:        conf.MetricsEnabled,
+		MetricsAddress:        conf.MetricsAddress,
+		APIEnabled:            conf.APIEnabled,
+		APIAddress:            conf.APIAddress,
+		HomeAssistantEnabled:  conf.HomeAssistantEnabled,
+		HomeAssistantPrefix:   conf.HomeAssistantPrefix,
+		InfluxEnabled:         conf.Influx.Enabled,
+		GridQuality:           conf.GridQuality,
+		ReportDeadband:        conf.ReportDeadband,
+		ReportDeadbands:       conf.ReportDeadbands,
+	}
+}
+
+func (s *Server) action(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, actionsPath)
+	if !isAction(name) {
+		writeError(w, http.StatusNotFound, "unknown action "+name)
+		return
+	}
+	result := ActionResult{Action: name, Status: "ok"}
+	if err := s.actions.RunSystemAction(name); err != nil {
+		log.Error("<api> ", err)
+		result.Status, result.Error = "error", err.Error()
+		writeJSON(w, http.StatusBadGateway, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// authorized checks the bearer token, without a configured token all actions are refused.
+func (s *Server) authorized(r *http.Request) bool {
+	token := s.configs.APIToken
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+func isAction(name string) bool {
+	for _, action := range handler.SystemActionNames() {
+		if action == name {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(val); err != nil {
+		log.Debug("<api> Can't write response - ", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,140 @@
+package restapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thingsplex/fronius/handler"
+	"github.com/thingsplex/fronius/model"
+	"github.com/thingsplex/fronius/utils"
+)
+
+type fakeAdapter struct {
+	ran     []string
+	err     error
+	configs *model.Configs
+}
+
+func (f *fakeAdapter) Health() handler.Health {
+	return handler.Health{Connected: true}
+}
+
+func (f *fakeAdapter) ConfigSnapshot() model.Configs {
+	return *f.configs
+}
+
+func (f *fakeAdapter) RunSystemAction(name string) error {
+	f.ran = append(f.ran, name)
+	return f.err
+}
+
+func newTestServer(t *testing.T) (*Server, *fakeAdapter, func()) {
+	workDir, err := ioutil.TempDir("", "fronius-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"data", "defaults"} {
+		os.MkdirAll(filepath.Join(workDir, dir), 0755)
+	}
+	if err := utils.CopyFile(filepath.Join("..", "..", "testdata", "defaults", "state.json"), filepath.Join(workDir, "defaults", "state.json")); err != nil {
+		t.Fatal(err)
+	}
+	state := model.NewStates(workDir)
+	configs := &model.Configs{Type: model.InverterTypeHybrid, APIToken: "secret", MqttPassword: "mqtt", Password: "inverter",
+		Influx: model.InfluxConfig{Enabled: true, Token: "influx"}}
+	adapter := &fakeAdapter{configs: configs}
+	return NewServer(configs, state, adapter, adapter, adapter), adapter, func() { os.RemoveAll(workDir) }
+}
+
+func request(s *Server, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestReadEndpoints(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	if rec := request(s, "GET", "/api/v1/live", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("live without measurements answered %d", rec.Code)
+	}
+
+	meas := model.NewMeasurements("powerflow")
+	meas.Site.PowerPV = 4200
+	meas.Devices = []model.DeviceMeasurement{{ID: "1", Type: model.DeviceTypeInverter, Power: 4200}}
+	s.state.SetMeasurements(meas)
+	s.state.SetDevices([]model.DeviceIdentity{{ID: "0", Type: model.DeviceTypeStorage, Serial: "P030T020Z2006"}})
+
+	summary := SiteSummary{}
+	rec := request(s, "GET", "/api/v1/site", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("site answered %d %s", rec.Code, rec.Body)
+	}
+	if !summary.Connected || summary.Site == nil || summary.Site.PowerPV != 4200 || summary.Devices != 1 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+
+	var devices []Device
+	json.Unmarshal(request(s, "GET", "/api/v1/devices", "").Body.Bytes(), &devices)
+	if len(devices) != 2 || devices[0].Identity == nil || devices[1].Measurement == nil || devices[1].Measurement.Power != 4200 {
+		t.Errorf("unexpected devices %+v", devices)
+	}
+
+	rec = request(s, "GET", "/api/v1/config", "")
+	conf := map[string]interface{}{}
+	json.Unmarshal(rec.Body.Bytes(), &conf)
+	if conf["type"] != model.InverterTypeHybrid || conf["influx_enabled"] != true {
+		t.Errorf("unexpected config %v", conf)
+	}
+	for _, secret := range []string{"secret", "mqtt", "inverter", "influx"} {
+		if strings.Contains(rec.Body.String(), `"`+secret+`"`) {
+			t.Errorf("config exposes %q: %s", secret, rec.Body)
+		}
+	}
+
+	if rec := request(s, "POST", "/api/v1/live", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST to a read endpoint answered %d", rec.Code)
+	}
+}
+
+func TestActions(t *testing.T) {
+	s, adapter, cleanup := newTestServer(t)
+	defer cleanup()
+	for _, token := range []string{"", "wrong"} {
+		if rec := request(s, "POST", "/api/v1/actions/forced_battery_storage", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q answered %d", token, rec.Code)
+		}
+	}
+	if rec := request(s, "POST", "/api/v1/actions/format_disk", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown action answered %d", rec.Code)
+	}
+	if rec := request(s, "POST", "/api/v1/actions/forced_battery_storage", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("action answered %d %s", rec.Code, rec.Body)
+	}
+	adapter.err = errors.New("not accepted")
+	result := ActionResult{}
+	rec := request(s, "POST", "/api/v1/actions/excess_solar_production_disabled", "secret")
+	json.Unmarshal(rec.Body.Bytes(), &result)
+	if rec.Code != http.StatusBadGateway || result.Status != "error" {
+		t.Errorf("failed action answered %d %+v", rec.Code, result)
+	}
+	if len(adapter.ran) != 2 || adapter.ran[0] != "forced_battery_storage" {
+		t.Errorf("unexpected actions %v", adapter.ran)
+	}
+
+	s.configs.APIToken = ""
+	if rec := request(s, "POST", "/api/v1/actions/forced_battery_storage", "secret"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("action without configured token answered %d", rec.Code)
+	}
+}
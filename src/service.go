@@ -4,24 +4,30 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/grandcat/zeroconf"
-	"github.com/thingsplex/fronius/fronius-api"
 
 	"github.com/futurehomeno/fimpgo"
 	"github.com/futurehomeno/fimpgo/edgeapp"
 	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/fronius/exporter"
+	"github.com/thingsplex/fronius/fronius-api"
 	"github.com/thingsplex/fronius/handler"
 	"github.com/thingsplex/fronius/model"
+	"github.com/thingsplex/fronius/restapi"
 	"github.com/thingsplex/fronius/utils"
 )
 
 func main() {
 
-	var workDir string
+	var workDir, replayFile string
 	flag.StringVar(&workDir, "c", "", "Work dir")
+	flag.StringVar(&replayFile, "replay", "", "Replay Solar API responses from a capture file instead of polling the inverter")
 	flag.Parse()
 	if workDir == "" {
 		workDir = "./"
@@ -38,57 +44,133 @@ func main() {
 		panic("Can't load config file.")
 	}
 
+	if replayFile != "" {
+		configs.ReplayFile, _ = filepath.Abs(replayFile)
+	}
+
 	err = states.LoadFromFile()
 	if err != nil {
 		appLifecycle.SetConfigState(edgeapp.ConfigStateNotConfigured)
 		fmt.Print(err)
 		panic("Not able to load state")
 	}
-	system := fronius.System{}
-	systemh := fronius.SystemHybrid{}
-	powerflow := fronius.Powerflow{}
-	// state := fronius.State{}
-
 	utils.SetupLog(configs.LogFile, configs.LogLevel, configs.LogFormat)
 	log.Info("--------------Starting fronius----------------")
 	appLifecycle.SetAppState(edgeapp.AppStateStarting, nil)
-	appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+	appLifecycle.SetAuthState(edgeapp.AuthStateNA)
 	appLifecycle.SetConfigState(edgeapp.ConfigStateNotConfigured)
-	appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+	appLifecycle.SetConnectionState(edgeapp.ConnStateConnecting)
 
 	log.Info("Work directory : ", configs.WorkDir)
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
 	mqtt := fimpgo.NewMqttTransport(configs.MqttServerURI, configs.MqttClientIdPrefix, configs.MqttUsername, configs.MqttPassword, true, 1, 1)
 	err = mqtt.Start()
 
 	if err != nil {
+		// the service is restarted by systemd
+		appLifecycle.SetAppState(edgeapp.AppStateStartupError, nil)
+		appLifecycle.SetLastError(err.Error())
 		log.Error("Can't connect to broker. Error: ", err.Error())
-	} else {
-		log.Info("----------------Connected------------------")
+		os.Exit(1)
 	}
-	defer mqtt.Stop()
-	appLifecycle.SetAppState(edgeapp.AppStateRunning, nil)
+	log.Info("----------------Connected------------------")
 
-	if err := edgeapp.NewSystemCheck().WaitForInternet(5 * time.Minute); err == nil {
-		log.Info("<main> Internet connection - OK")
-	} else {
-		log.Error("<main> Internet connection - ERROR")
+	checkInverter(configs, appLifecycle)
+
+	fimpRouter := handler.NewFromFimpRouter(mqtt, appLifecycle, configs, states)
+	poller := handler.NewPoller(configs, states, fimpRouter, appLifecycle)
+	fimpRouter.SetPoller(poller)
+	statistics := model.NewStatistics(configs)
+	if err := statistics.LoadFromFile(); err != nil {
+		log.Error("<main> Can't load statistics. Error: ", err)
 	}
-	if states.IsConfigured() && err == nil {
-		appLifecycle.SetConfigState(edgeapp.ConfigStateNotConfigured)
-		appLifecycle.SetConnectionState(edgeapp.ConnStateConnected)
-		appLifecycle.SetAuthState(edgeapp.AuthStateAuthenticated)
-	} else {
-		appLifecycle.SetConfigState(edgeapp.ConfigStateNotConfigured)
-		appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+	poller.AddSink(statistics)
+	fimpRouter.SetStatistics(statistics)
+	gridEvents := model.NewGridEvents(configs)
+	if err := gridEvents.LoadFromFile(); err != nil {
+		log.Error("<main> Can't load grid events. Error: ", err)
 	}
+	poller.AddSink(handler.NewGridMonitor(fimpRouter, gridEvents))
+	fimpRouter.SetGridEvents(gridEvents)
 
-	fimpRouter := handler.NewFromFimpRouter(mqtt, appLifecycle, configs, states)
+	metrics := exporter.NewPrometheus(configs, states, poller, fimpRouter)
+	if configs.MetricsEnabled {
+		if err := metrics.Start(); err != nil {
+			log.Error("<main> Can't start metrics endpoint. Error: ", err)
+		}
+	}
+	influx := exporter.NewInflux(configs)
+	if configs.Influx.Enabled {
+		poller.AddSink(influx)
+		influx.Start()
+	}
+	api := restapi.NewServer(configs, states, poller, fimpRouter, fimpRouter)
+	if configs.APIEnabled {
+		if err := api.Start(); err != nil {
+			log.Error("<main> Can't start REST API. Error: ", err)
+		}
+	}
+
+	go browseLocalServices()
+
+	// the sinks are all added, polling starts when an inverter is configured, right away or later
+	// over cmd.config.extended_set
 	fimpRouter.Start()
+	fimpRouter.UpdateAppState()
+
+	sig := <-signals
+	signal.Stop(signals)
+	log.Info("<main> Received ", sig, ", shutting down")
+	appLifecycle.SetAppState(edgeapp.AppStateTerminate, nil)
+	// an extended_set must not start the poller again while it stops
+	fimpRouter.Stop()
+	poller.Stop()
+	metrics.Stop()
+	influx.Stop()
+	api.Stop()
+	if err := states.SaveToFile(); err != nil {
+		log.Error("<main> Can't save state. Error: ", err)
+	}
+	if err := statistics.SaveToFile(); err != nil {
+		log.Error("<main> Can't save statistics. Error: ", err)
+	}
+	if err := gridEvents.SaveToFile(); err != nil {
+		log.Error("<main> Can't save grid events. Error: ", err)
+	}
+	appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+	fimpRouter.PublishAppState()
+	fimpRouter.SendHomeAssistantAvailability(false)
+	mqtt.Stop()
+	log.Info("--------------Stopped fronius----------------")
+}
+
+// checkInverter logs if the configured inverter can be reached on the local network and sets the
+// connection state accordingly. It doesn't block the startup, an unreachable inverter is polled anyway.
+func checkInverter(configs *model.Configs, appLifecycle *edgeapp.Lifecycle) {
+	if !configs.IsConfigured() || configs.IsReplay() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	version, err := fronius.NewClient(configs.Host, nil).GetAPIVersion(ctx)
+	if err != nil {
+		log.Warn("<main> Inverter at ", configs.Host, " can't be reached - ", err)
+		appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+		return
+	}
+	log.Info("<main> Inverter at ", configs.Host, " reachable - OK, Solar API version ", version.APIVersion)
+	appLifecycle.SetConnectionState(edgeapp.ConnStateConnected)
+}
 
+// browseLocalServices logs the mDNS services on the local network, which helps to find the inverter.
+func browseLocalServices() {
 	resolver, err := zeroconf.NewResolver(nil)
 	if err != nil {
-		log.Fatalln("Failed to initialize resolver:", err.Error())
+		log.Error("Failed to initialize resolver:", err.Error())
+		return
 	}
 
 	entries := make(chan *zeroconf.ServiceEntry)
@@ -103,114 +185,8 @@ func main() {
 	defer cancel()
 	err = resolver.Browse(ctx, "", ".local", entries)
 	if err != nil {
-		log.Fatalln("Failed to browse:", err.Error())
+		log.Error("Failed to browse:", err.Error())
+		return
 	}
-
 	<-ctx.Done()
-
-	PollTime := configs.PollTimeSec
-	// test := false
-	for {
-		appLifecycle.WaitForState("main", edgeapp.AppStateRunning)
-		log.Info("--------------Starting ticker---------------")
-		ticker := time.NewTicker(time.Duration(PollTime) * time.Second)
-		for ; true; <-ticker.C {
-			if configs.Host != "host_ip" {
-
-				if configs.Type == "not_hybrid" {
-
-					req, err := http.NewRequest("GET", fronius.GetRealTimeDataURL(fmt.Sprintf("%s%s%s", "http://", configs.Host, ":80")), nil)
-					log.Debug(req)
-					if err != nil {
-						log.Error(fmt.Errorf("Can't get measurements - ", err))
-					}
-					resp, err := http.DefaultClient.Do(req)
-					if err != nil {
-						log.Error(err)
-					} else {
-						measurements, err := system.NewResponse(resp)
-						if err != nil {
-							log.Error(err)
-						} else {
-							if appLifecycle.ConfigState() == edgeapp.ConfigStateNotConfigured {
-								inclReport := model.SendInclusionReport()
-
-								msg := fimpgo.NewMessage("evt.thing.inclusion_report", "fronius", fimpgo.VTypeObject, inclReport, nil, nil, nil)
-								adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "fronius", ResourceAddress: "1"}
-								mqtt.Publish(&adr, msg)
-								appLifecycle.SetConfigState(edgeapp.ConfigStateConfigured)
-							}
-							states.Systems = measurements
-							fimpRouter.SendMeasurements(measurements)
-						}
-					}
-				} else if configs.Type == "hybrid" {
-					req, err := http.NewRequest("GET", fronius.GetRealTimeDataURL(fmt.Sprintf("%s%s%s", "http://", configs.Host, ":80")), nil)
-					log.Debug(req)
-					if err != nil {
-						log.Error(fmt.Errorf("Can't get InverterRealTimeData - ", err))
-					}
-					resp, err := http.DefaultClient.Do(req)
-					if err != nil {
-						log.Error(err)
-					} else {
-						measurements, err := systemh.NewHybridResponse(resp)
-						if err != nil {
-							log.Error(err)
-						} else {
-							if appLifecycle.ConfigState() == edgeapp.ConfigStateNotConfigured {
-								inclReport := model.SendHybridInclusionReport()
-
-								msg := fimpgo.NewMessage("evt.thing.inclusion_report", "fronius", fimpgo.VTypeObject, inclReport, nil, nil, nil)
-								adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "fronius", ResourceAddress: "1"}
-								mqtt.Publish(&adr, msg)
-								appLifecycle.SetConfigState(edgeapp.ConfigStateConfigured)
-							}
-							states.Systemsh = measurements
-						}
-					}
-
-					req, err = http.NewRequest("GET", "http://"+configs.Host+":80/status/powerflow", nil)
-					log.Debug(req)
-					if err != nil {
-						log.Error(fmt.Errorf("Can't get powerflow - ", err))
-					}
-					resp, err = http.DefaultClient.Do(req)
-					if err != nil {
-						log.Error(err)
-					} else {
-						powerflow, err := powerflow.NewPowerflowResponse(resp)
-						if err != nil {
-							log.Error(err)
-						} else {
-							states.Powerflow = powerflow
-							fimpRouter.SendHybridMeasurements(powerflow)
-
-						}
-					}
-					// do things for hybrid inverter
-					// get readable
-					// get powerflow
-					// send
-				}
-			} else {
-				log.Debug("-------NOT CONNECTED------")
-				// Do nothing
-				// if !test {
-				// 	log.Debug("THIS IS ONLY FOR TESTING")
-				// 	inclReport := model.SendHybridInclusionReport()
-
-				// 	msg := fimpgo.NewMessage("evt.thing.inclusion_report", "fronius", fimpgo.VTypeObject, inclReport, nil, nil, nil)
-				// 	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "fronius", ResourceAddress: "1"}
-				// 	mqtt.Publish(&adr, msg)
-				// 	test = true
-				// }
-			}
-			states.SaveToFile()
-		}
-		appLifecycle.WaitForState(edgeapp.AppStateNotConfigured, "main")
-	}
-
-	mqtt.Stop()
-	time.Sleep(5 * time.Second)
 }
@@ -0,0 +1,163 @@
+package simulator
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Broker is a minimal in-process MQTT 3.1.1 broker for tests. It supports QoS 0 and 1 publishing,
+// delivers everything with QoS 0 and has no retained messages or persistent sessions.
+type Broker struct {
+	listener net.Listener
+	mux      sync.Mutex
+	clients  map[*brokerClient]bool
+}
+
+type brokerClient struct {
+	conn     net.Conn
+	writeMux sync.Mutex
+	topics   map[string]bool
+}
+
+// NewBroker starts a broker listening on a random local port.
+func NewBroker() (*Broker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{listener: listener, clients: make(map[*brokerClient]bool)}
+	go b.accept()
+	return b, nil
+}
+
+// URI returns the server URI to connect to, e.g. tcp://127.0.0.1:41234
+func (b *Broker) URI() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *Broker) Close() {
+	b.listener.Close()
+	b.mux.Lock()
+	for c := range b.clients {
+		c.conn.Close()
+	}
+	b.mux.Unlock()
+}
+
+func (b *Broker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	packet, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	if _, ok := packet.(*packets.ConnectPacket); !ok {
+		return
+	}
+	c := &brokerClient{conn: conn, topics: make(map[string]bool)}
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = packets.Accepted
+	if c.write(connack) != nil {
+		return
+	}
+	b.mux.Lock()
+	b.clients[c] = true
+	b.mux.Unlock()
+	defer func() {
+		b.mux.Lock()
+		delete(b.clients, c)
+		b.mux.Unlock()
+	}()
+
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.SubscribePacket:
+			b.mux.Lock()
+			for _, topic := range p.Topics {
+				c.topics[topic] = true
+			}
+			b.mux.Unlock()
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			suback.ReturnCodes = make([]byte, len(p.Topics))
+			c.write(suback)
+		case *packets.UnsubscribePacket:
+			b.mux.Lock()
+			for _, topic := range p.Topics {
+				delete(c.topics, topic)
+			}
+			b.mux.Unlock()
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			c.write(unsuback)
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				c.write(puback)
+			}
+			b.route(p.TopicName, p.Payload)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *Broker) route(topic string, payload []byte) {
+	b.mux.Lock()
+	var receivers []*brokerClient
+	for c := range b.clients {
+		for filter := range c.topics {
+			if topicMatches(filter, topic) {
+				receivers = append(receivers, c)
+				break
+			}
+		}
+	}
+	b.mux.Unlock()
+	for _, c := range receivers {
+		publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		publish.TopicName = topic
+		publish.Payload = payload
+		c.write(publish)
+	}
+}
+
+func (c *brokerClient) write(packet packets.ControlPacket) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	return packet.Write(c.conn)
+}
+
+// topicMatches matches a topic against a subscription filter with + and # wildcards.
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
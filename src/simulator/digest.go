@@ -0,0 +1,72 @@
+package simulator
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	digestRealm = "Webinterface area"
+	digestNonce = "5d3f1b2a9c4e8f7061a2b3c4d5e6f708"
+)
+
+// handleConfig serves the internal /config endpoints. Like the Datamanager it challenges with
+// X-Www-Authenticate instead of WWW-Authenticate, so browsers don't show a login dialog.
+func (s *Simulator) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("X-Www-Authenticate", fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth"`, digestRealm, digestNonce))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mux.Lock()
+	s.configWrites = append(s.configWrites, ConfigWrite{Path: r.URL.Path, Body: string(body)})
+	s.mux.Unlock()
+	writeJSON(w, object{"writeSuccess": []string{}, "errors": []string{}})
+}
+
+func (s *Simulator) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Digest ") {
+		return false
+	}
+	params := parseDigest(strings.TrimPrefix(auth, "Digest "))
+	s.mux.Lock()
+	username, password := s.username, s.password
+	s.mux.Unlock()
+	if params["username"] != username || params["nonce"] != digestNonce {
+		return false
+	}
+	ha1 := md5Hex(username + ":" + digestRealm + ":" + password)
+	ha2 := md5Hex(r.Method + ":" + params["uri"])
+	expected := md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+	return params["response"] == expected
+}
+
+func parseDigest(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+func md5Hex(text string) string {
+	sum := md5.Sum([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,325 @@
+package simulator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	statusOK                 = 0
+	statusDeviceNotAvailable = 12
+)
+
+type object = map[string]interface{}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func head(query url.Values, code int) object {
+	args := object{}
+	for key := range query {
+		args[key] = query.Get(key)
+	}
+	reason := ""
+	if code == statusDeviceNotAvailable {
+		reason = "Transfer timeout."
+	}
+	return object{
+		"RequestArguments": args,
+		"Status":           object{"Code": code, "Reason": reason, "UserMessage": ""},
+		"Timestamp":        time.Now().Format(time.RFC3339),
+	}
+}
+
+func response(query url.Values, code int, data object) object {
+	return object{"Head": head(query, code), "Body": object{"Data": data}}
+}
+
+// systemValue is a value in System scope, keyed by device id.
+func systemValue(unit string, value float64) object {
+	return object{"Unit": unit, "Values": object{"1": value}}
+}
+
+// deviceValue is a value in Device scope.
+func deviceValue(unit string, value float64) object {
+	return object{"Unit": unit, "Value": value}
+}
+
+func sleeping(scenario Scenario) bool {
+	return scenario == ScenarioNight || scenario == ScenarioNightEmpty
+}
+
+// asleep returns the response of a logger whose inverters sleep.
+func asleep(scenario Scenario, query url.Values) (object, bool) {
+	switch scenario {
+	case ScenarioNight:
+		return response(query, statusDeviceNotAvailable, object{}), true
+	case ScenarioNightEmpty:
+		return response(query, statusOK, object{}), true
+	}
+	return nil, false
+}
+
+func inverterRealtimeData(scenario Scenario, site Site, query url.Values) interface{} {
+	if resp, ok := asleep(scenario, query); ok {
+		return resp
+	}
+	if query.Get("DataCollection") == "MinMaxInverterData" {
+		return response(query, statusOK, minMaxInverterData(site))
+	}
+	if query.Get("Scope") != "Device" {
+		return response(query, statusOK, object{
+			"PAC":          systemValue("W", site.PowerPV),
+			"DAY_ENERGY":   systemValue("Wh", site.EnergyDay),
+			"YEAR_ENERGY":  systemValue("Wh", site.EnergyYear),
+			"TOTAL_ENERGY": systemValue("Wh", site.EnergyTotal),
+		})
+	}
+	data := object{
+		"DAY_ENERGY": deviceValue("Wh", site.EnergyDay),
+		"DeviceStatus": object{
+			"ErrorCode":              0,
+			"LEDColor":               2,
+			"LEDState":               0,
+			"MgmtTimerRemainingTime": -1,
+			"StateToReset":           false,
+			"StatusCode":             site.StatusCode,
+		},
+		"FAC":          deviceValue("Hz", site.Frequency),
+		"IAC":          deviceValue("A", site.CurrentAC),
+		"IDC":          deviceValue("A", site.CurrentDC),
+		"PAC":          deviceValue("W", site.PowerPV),
+		"TOTAL_ENERGY": deviceValue("Wh", site.EnergyTotal),
+		"UAC":          deviceValue("V", site.VoltageAC),
+		"UDC":          deviceValue("V", site.VoltageDC),
+		"YEAR_ENERGY":  deviceValue("Wh", site.EnergyYear),
+	}
+	if site.VoltageDC2 > 0 {
+		data["UDC_2"] = deviceValue("V", site.VoltageDC2)
+		data["IDC_2"] = deviceValue("A", site.CurrentDC2)
+	}
+	return response(query, statusOK, data)
+}
+
+func minMaxInverterData(site Site) object {
+	return object{
+		"DAY_PMAX":     deviceValue("W", site.PowerMaxDay),
+		"DAY_UACMAX":   deviceValue("V", site.VoltageAC+8.7),
+		"DAY_UACMIN":   deviceValue("V", site.VoltageAC-5.2),
+		"DAY_UDCMAX":   deviceValue("V", site.VoltageDC+61),
+		"YEAR_PMAX":    deviceValue("W", 5012),
+		"YEAR_UACMAX":  deviceValue("V", 251.3),
+		"YEAR_UACMIN":  deviceValue("V", 212.8),
+		"YEAR_UDCMAX":  deviceValue("V", 602.4),
+		"TOTAL_PMAX":   deviceValue("W", 5187),
+		"TOTAL_UACMAX": deviceValue("V", 253.9),
+		"TOTAL_UACMIN": deviceValue("V", 207.1),
+		"TOTAL_UDCMAX": deviceValue("V", 640.5),
+	}
+}
+
+// componentsReadable is the internal components API of hybrid inverters, only the DC input
+// channels of the inverter component are simulated.
+func componentsReadable(scenario Scenario, site Site, query url.Values) interface{} {
+	channels := object{
+		"PV_VOLTAGE_MEAN_01_F32":     site.VoltageDC,
+		"PV_CURRENT_MEAN_01_F32":     site.CurrentDC,
+		"PV_POWERACTIVE_MEAN_01_F32": site.VoltageDC * site.CurrentDC,
+	}
+	if site.VoltageDC2 > 0 {
+		channels["PV_VOLTAGE_MEAN_02_F32"] = site.VoltageDC2
+		channels["PV_CURRENT_MEAN_02_F32"] = site.CurrentDC2
+		channels["PV_POWERACTIVE_MEAN_02_F32"] = site.VoltageDC2 * site.CurrentDC2
+	}
+	return object{
+		"Body": object{"Data": object{"393216": object{"channels": channels}}},
+		"Head": object{"Status": object{"Code": statusOK}, "Timestamp": time.Now().Format(time.RFC3339)},
+	}
+}
+
+func activeDeviceInfo(site Site, query url.Values) interface{} {
+	data := object{
+		"Inverter": object{"1": object{"DT": 123, "Serial": "28136344", "CustomName": "Symo"}},
+		"Meter":    object{},
+		"Storage":  object{},
+	}
+	if site.Hybrid {
+		data["Inverter"] = object{"1": object{"DT": 1, "Serial": "31234567", "CustomName": "GEN24"}}
+		data["Storage"] = object{"0": object{"DT": -1, "Serial": "P030T020Z2006"}}
+	}
+	if site.HasMeter() {
+		data["Meter"] = object{"0": object{"DT": -1, "Serial": "19480123"}}
+	}
+	return response(query, statusOK, data)
+}
+
+func meterRealtimeData(scenario Scenario, site Site, query url.Values) interface{} {
+	if !site.HasMeter() {
+		return response(query, statusOK, object{})
+	}
+	return response(query, statusOK, object{
+		"0": object{
+			"Details": object{
+				"Manufacturer": "Fronius",
+				"Model":        "Smart Meter 63A",
+				"Serial":       "19480123",
+			},
+			"Current_AC_Phase_1":          site.PowerGrid / 3 / site.VoltageAC,
+			"Current_AC_Phase_2":          site.PowerGrid / 3 / site.VoltageAC,
+			"Current_AC_Phase_3":          site.PowerGrid / 3 / site.VoltageAC,
+			"Frequency_Phase_Average":     site.Frequency,
+			"Meter_Location_Current":      0,
+			"PowerReal_P_Phase_1":         site.PowerGrid / 3,
+			"PowerReal_P_Phase_2":         site.PowerGrid / 3,
+			"PowerReal_P_Phase_3":         site.PowerGrid / 3,
+			"PowerReal_P_Sum":             site.PowerGrid,
+			"Voltage_AC_Phase_1":          site.VoltageAC,
+			"Voltage_AC_Phase_2":          site.VoltageAC,
+			"Voltage_AC_Phase_3":          site.VoltageAC,
+			"EnergyReal_WAC_Sum_Consumed": 3125410,
+			"EnergyReal_WAC_Sum_Produced": 9547213,
+			"TimeStamp":                   time.Now().Unix(),
+			"Visible":                     1,
+		},
+	})
+}
+
+func storageRealtimeData(scenario Scenario, site Site, query url.Values) interface{} {
+	if !site.Hybrid {
+		return response(query, statusOK, object{})
+	}
+	return response(query, statusOK, object{
+		"0": object{
+			"Controller": object{
+				"Capacity_Maximum":       11520,
+				"Current_DC":             site.PowerBattery / 400,
+				"DesignedCapacity":       11520,
+				"Details":                object{"Manufacturer": "BYD", "Model": "BYD Battery-Box Premium HV", "Serial": "P030T020Z2006"},
+				"Enable":                 1,
+				"StateOfCharge_Relative": site.Soc,
+				"Status_BatteryCell":     3,
+				"Temperature_Cell":       24.5,
+				"TimeStamp":              time.Now().Unix(),
+				"Voltage_DC":             400.2,
+			},
+			"Modules": []interface{}{},
+		},
+	})
+}
+
+func powerFlowRealtimeData(scenario Scenario, site Site, query url.Values) interface{} {
+	inverters := object{}
+	if !sleeping(scenario) {
+		inverters["1"] = powerflowInverter(site)
+	}
+	return response(query, statusOK, object{
+		"Inverters": inverters,
+		"Site":      powerflowSite(scenario, site),
+		"Version":   "12",
+	})
+}
+
+// statusPowerflow is the internal powerflow endpoint of hybrid inverters, which lists inverters
+// as array and has no Solar API header.
+func statusPowerflow(scenario Scenario, site Site, query url.Values) interface{} {
+	inverters := []interface{}{}
+	if !sleeping(scenario) {
+		inverter := powerflowInverter(site)
+		inverter["ID"] = 1
+		inverter["CID"] = 0
+		inverters = append(inverters, inverter)
+	}
+	now := time.Now()
+	return object{
+		"common":    object{"datestamp": now.Format("02.01.2006"), "timestamp": now.Format("15:04:05")},
+		"inverters": inverters,
+		"site":      powerflowSite(scenario, site),
+		"version":   "12",
+	}
+}
+
+func powerflowInverter(site Site) object {
+	inverter := object{
+		"DT":      1,
+		"P":       site.PowerPV,
+		"E_Day":   site.EnergyDay,
+		"E_Year":  site.EnergyYear,
+		"E_Total": site.EnergyTotal,
+	}
+	if site.Hybrid {
+		inverter["BatMode"] = 1
+		inverter["SOC"] = site.Soc
+	}
+	return inverter
+}
+
+func powerflowSite(scenario Scenario, site Site) object {
+	result := object{
+		"BackupMode":          false,
+		"BatteryStandby":      false,
+		"E_Day":               site.EnergyDay,
+		"E_Year":              site.EnergyYear,
+		"E_Total":             site.EnergyTotal,
+		"Meter_Location":      "grid",
+		"Mode":                "produce-only",
+		"P_Akku":              nil,
+		"P_Grid":              nil,
+		"P_Load":              nil,
+		"P_PV":                site.PowerPV,
+		"rel_Autonomy":        nil,
+		"rel_SelfConsumption": nil,
+	}
+	if sleeping(scenario) {
+		result["P_PV"] = nil
+	}
+	if site.Hybrid {
+		result["Mode"] = "bidirectional"
+		result["P_Akku"] = site.PowerBattery
+		result["P_Grid"] = site.PowerGrid
+		result["P_Load"] = site.PowerLoad
+		result["rel_Autonomy"] = relAutonomy(site)
+		result["rel_SelfConsumption"] = relSelfConsumption(site)
+	}
+	return result
+}
+
+// relAutonomy is the share of the load not covered by the grid in percent.
+func relAutonomy(site Site) float64 {
+	if site.PowerLoad == 0 || site.PowerGrid <= 0 {
+		return 100
+	}
+	return 100 * (1 - site.PowerGrid/-site.PowerLoad)
+}
+
+// relSelfConsumption is the share of the production not fed into the grid in percent.
+func relSelfConsumption(site Site) float64 {
+	if site.PowerPV == 0 || site.PowerGrid >= 0 {
+		return 100
+	}
+	return 100 * (1 - -site.PowerGrid/site.PowerPV)
+}
+
+func archiveData(scenario Scenario, site Site, query url.Values) interface{} {
+	if resp, ok := asleep(scenario, query); ok {
+		return resp
+	}
+	return response(query, statusOK, object{
+		"inverter/1": object{
+			"NodeType":   97,
+			"DeviceType": 232,
+			"Start":      query.Get("StartDate"),
+			"End":        query.Get("EndDate"),
+			"Data": object{
+				"EnergyReal_WAC_Sum_Produced": object{
+					"Unit":     "Wh",
+					"_comment": "channelId=67830024",
+					"Values":   object{"0": 0, "300": site.PowerPV / 12, "600": site.PowerPV / 12},
+				},
+			},
+		},
+	})
+}
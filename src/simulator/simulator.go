@@ -0,0 +1,287 @@
+// Package simulator provides a fake Fronius Datamanager and an embedded MQTT broker, so the
+// adapter can be run end to end without any hardware.
+package simulator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Scenario selects how the simulated Datamanager answers Solar API requests.
+type Scenario int
+
+const (
+	// ScenarioNormal answers with the configured site values.
+	ScenarioNormal Scenario = iota
+	// ScenarioNight answers like a logger whose inverters sleep, with status code 12 and no data.
+	ScenarioNight
+	// ScenarioNightEmpty answers with status OK but an empty Data body, as some loggers do at night.
+	ScenarioNightEmpty
+	// ScenarioError answers with HTTP 500.
+	ScenarioError
+	// ScenarioMalformed answers with truncated JSON.
+	ScenarioMalformed
+)
+
+// Step runs a scenario for the next Count Solar API requests.
+type Step struct {
+	Scenario Scenario
+	Count    int
+}
+
+// Site holds the values the simulated installation reports. Power is in W, energy in Wh.
+// Grid power is positive when importing and battery power positive when discharging.
+// Meter adds a Smart Meter at the feed-in point to a non-hybrid site, hybrid sites always have one.
+// VoltageDC2 and CurrentDC2 are the second DC input, which is only reported if the voltage is set.
+// PowerMaxDay is the peak power of the day, the other min/max values are derived from the voltages.
+type Site struct {
+	Hybrid       bool
+	Meter        bool
+	PowerPV      float64
+	PowerGrid    float64
+	PowerLoad    float64
+	PowerBattery float64
+	Soc          float64
+	EnergyDay    float64
+	EnergyYear   float64
+	EnergyTotal  float64
+	VoltageAC    float64
+	CurrentAC    float64
+	Frequency    float64
+	VoltageDC    float64
+	CurrentDC    float64
+	VoltageDC2   float64
+	CurrentDC2   float64
+	PowerMaxDay  float64
+	StatusCode   int
+}
+
+// ConfigWrite is a successfully authenticated write to one of the internal /config endpoints.
+type ConfigWrite struct {
+	Path string
+	Body string
+}
+
+// Simulator is a fake Fronius Datamanager serving Solar API v1 and the internal endpoints.
+type Simulator struct {
+	server       *httptest.Server
+	mux          sync.Mutex
+	site         Site
+	scenario     Scenario
+	script       []Step
+	delay        time.Duration
+	username     string
+	password     string
+	requests     map[string]int
+	configWrites []ConfigWrite
+}
+
+// DefaultSite is a non-hybrid inverter producing on a sunny day.
+func DefaultSite() Site {
+	return Site{
+		PowerPV:     1604,
+		EnergyDay:   8190,
+		EnergyYear:  7779826,
+		EnergyTotal: 27280602,
+		VoltageAC:   231.4,
+		CurrentAC:   6.93,
+		Frequency:   49.98,
+		VoltageDC:   412.3,
+		CurrentDC:   4.11,
+		VoltageDC2:  398.6,
+		CurrentDC2:  0.35,
+		PowerMaxDay: 3821,
+		StatusCode:  7,
+	}
+}
+
+// HybridSite is a hybrid inverter with smart meter and a charging battery.
+func HybridSite() Site {
+	site := DefaultSite()
+	site.Hybrid = true
+	site.PowerPV = 4200
+	site.PowerGrid = -1200
+	site.PowerLoad = -2400
+	site.PowerBattery = -600
+	site.Soc = 57.5
+	return site
+}
+
+// MeterSite is a non-hybrid inverter with a Smart Meter, exporting part of its production.
+func MeterSite() Site {
+	site := DefaultSite()
+	site.Meter = true
+	site.PowerGrid = -604
+	site.PowerLoad = -1000
+	return site
+}
+
+// HasMeter tells if the site has a Smart Meter.
+func (site Site) HasMeter() bool {
+	return site.Hybrid || site.Meter
+}
+
+// New starts a simulator serving DefaultSite. Close has to be called when done.
+func New() *Simulator {
+	sim := &Simulator{
+		site:     DefaultSite(),
+		username: "technician",
+		password: "Solcelle2021",
+		requests: make(map[string]int),
+	}
+	sim.server = httptest.NewServer(sim.routes())
+	return sim
+}
+
+func (s *Simulator) Close() {
+	s.server.Close()
+}
+
+// URL returns the base URL of the simulator, e.g. http://127.0.0.1:41234
+func (s *Simulator) URL() string {
+	return s.server.URL
+}
+
+// Host returns host:port of the simulator, as it is set in the adapter's host config.
+func (s *Simulator) Host() string {
+	u, _ := url.Parse(s.server.URL)
+	return u.Host
+}
+
+func (s *Simulator) SetSite(site Site) {
+	s.mux.Lock()
+	s.site = site
+	s.mux.Unlock()
+}
+
+// UpdateSite changes the site values in place.
+func (s *Simulator) UpdateSite(update func(site *Site)) {
+	s.mux.Lock()
+	update(&s.site)
+	s.mux.Unlock()
+}
+
+// SetScenario sets the scenario used when no script is running.
+func (s *Simulator) SetScenario(scenario Scenario) {
+	s.mux.Lock()
+	s.scenario = scenario
+	s.mux.Unlock()
+}
+
+// Script runs the steps in order for the following Solar API requests, then falls back to the
+// scenario set with SetScenario.
+func (s *Simulator) Script(steps ...Step) {
+	s.mux.Lock()
+	s.script = append(s.script[:0], steps...)
+	s.mux.Unlock()
+}
+
+// SetDelay delays every response, to simulate a slow or hanging Datamanager.
+func (s *Simulator) SetDelay(delay time.Duration) {
+	s.mux.Lock()
+	s.delay = delay
+	s.mux.Unlock()
+}
+
+// SetCredentials changes the user the /config endpoints accept.
+func (s *Simulator) SetCredentials(username, password string) {
+	s.mux.Lock()
+	s.username, s.password = username, password
+	s.mux.Unlock()
+}
+
+// Requests returns how many requests were made to path.
+func (s *Simulator) Requests(path string) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.requests[path]
+}
+
+// ConfigWrites returns all authenticated writes to the /config endpoints.
+func (s *Simulator) ConfigWrites() []ConfigWrite {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]ConfigWrite(nil), s.configWrites...)
+}
+
+// nextScenario returns the scenario and site values for the next request and advances the script.
+func (s *Simulator) nextScenario() (Scenario, Site) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for len(s.script) > 0 && s.script[0].Count <= 0 {
+		s.script = s.script[1:]
+	}
+	if len(s.script) == 0 {
+		return s.scenario, s.site
+	}
+	s.script[0].Count--
+	return s.script[0].Scenario, s.site
+}
+
+func (s *Simulator) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/solar_api/GetAPIVersion.cgi", s.handleAPIVersion)
+	mux.HandleFunc("/solar_api/v1/GetActiveDeviceInfo.cgi", s.handleActiveDeviceInfo)
+	mux.HandleFunc("/solar_api/v1/GetInverterRealtimeData.cgi", s.solarAPI(inverterRealtimeData))
+	mux.HandleFunc("/solar_api/v1/GetMeterRealtimeData.cgi", s.solarAPI(meterRealtimeData))
+	mux.HandleFunc("/solar_api/v1/GetStorageRealtimeData.cgi", s.solarAPI(storageRealtimeData))
+	mux.HandleFunc("/solar_api/v1/GetPowerFlowRealtimeData.fcgi", s.solarAPI(powerFlowRealtimeData))
+	mux.HandleFunc("/solar_api/v1/GetArchiveData.cgi", s.solarAPI(archiveData))
+	mux.HandleFunc("/status/powerflow", s.solarAPI(statusPowerflow))
+	mux.HandleFunc("/components/cache/readable", s.solarAPI(componentsReadable))
+	mux.HandleFunc("/config/batteries", s.handleConfig)
+	mux.HandleFunc("/config/exportlimit", s.handleConfig)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mux.Lock()
+		s.requests[r.URL.Path]++
+		delay := s.delay
+		s.mux.Unlock()
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+type responseBuilder func(scenario Scenario, site Site, query url.Values) interface{}
+
+func (s *Simulator) solarAPI(build responseBuilder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scenario, site := s.nextScenario()
+		switch scenario {
+		case ScenarioError:
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		case ScenarioMalformed:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"Body" : {"Data" : {"PAC" : {"Unit" : "W", "Values" : {"1" : 16`))
+			return
+		}
+		writeJSON(w, build(scenario, site, r.URL.Query()))
+	}
+}
+
+// handleActiveDeviceInfo doesn't follow the scenario, the Datamanager knows its devices while
+// the inverters sleep.
+func (s *Simulator) handleActiveDeviceInfo(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	site := s.site
+	s.mux.Unlock()
+	writeJSON(w, activeDeviceInfo(site, r.URL.Query()))
+}
+
+func (s *Simulator) handleAPIVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"APIVersion":         1,
+		"BaseURL":            "/solar_api/v1/",
+		"CompatibilityRange": "1.6-3",
+	})
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"math"
+	"time"
+)
+
+const sunriseElevation = -0.833
+
+// SolarElevation returns the elevation of the sun in degrees at time t for the given coordinates.
+// It uses the low precision NOAA formulas, which are accurate to about a minute of sunrise time.
+func SolarElevation(t time.Time, lat, lon float64) float64 {
+	n := float64(t.Unix())/86400 + 2440587.5 - 2451545.0
+	meanLon := math.Mod(280.460+0.9856474*n, 360)
+	meanAnomaly := rad(math.Mod(357.528+0.9856003*n, 360))
+	eclipticLon := rad(meanLon + 1.915*math.Sin(meanAnomaly) + 0.020*math.Sin(2*meanAnomaly))
+	obliquity := rad(23.439 - 0.0000004*n)
+
+	declination := math.Asin(math.Sin(obliquity) * math.Sin(eclipticLon))
+	rightAscension := math.Atan2(math.Cos(obliquity)*math.Sin(eclipticLon), math.Cos(eclipticLon))
+	siderealTime := math.Mod(18.697374558+24.06570982441908*n, 24) * 15
+	hourAngle := rad(siderealTime+lon) - rightAscension
+
+	latRad := rad(lat)
+	elevation := math.Asin(math.Sin(latRad)*math.Sin(declination) + math.Cos(latRad)*math.Cos(declination)*math.Cos(hourAngle))
+	return elevation * 180 / math.Pi
+}
+
+// IsSunUp returns true between sunrise and sunset at the given coordinates.
+func IsSunUp(t time.Time, lat, lon float64) bool {
+	return SolarElevation(t, lat, lon) > sunriseElevation
+}
+
+func rad(deg float64) float64 {
+	return deg * math.Pi / 180
+}